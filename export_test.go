@@ -0,0 +1,9 @@
+package redblacktrees
+
+import "cmp"
+
+// SetSize overwrites the stored subtree size of n so tests can simulate a
+// corrupted counter.
+func SetSize[K cmp.Ordered, V any](n *Node[K, V], size int) {
+	n.size = size
+}
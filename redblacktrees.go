@@ -2,7 +2,18 @@ package redblacktrees
 
 import (
 	"cmp"
+	"container/heap"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"iter"
+	"math"
+	"math/bits"
+	"reflect"
+	"slices"
+	"time"
+	"unsafe"
 )
 
 type color bool
@@ -13,6 +24,12 @@ const (
 )
 
 // Node represents a node in a red-black tree.
+//
+// A *Node keeps the same key for as long as it is in the tree. Rebalancing and
+// deletion relink nodes but never move keys or values between them, so a held
+// node stays valid when other keys are inserted or deleted and after Rebuild.
+// It becomes invalid once its own key is deleted, or after Reset, Clear, or
+// ClearAndZero.
 type Node[K cmp.Ordered, V any] struct {
 	key    K
 	value  V
@@ -21,6 +38,7 @@ type Node[K cmp.Ordered, V any] struct {
 	right  *Node[K, V]
 	parent *Node[K, V]
 	size   int
+	agg    any // augmented subtree data, see augmenter
 }
 
 // Key returns the key of the node.
@@ -33,9 +51,65 @@ func (n *Node[K, V]) Value() V {
 	return n.value
 }
 
+// SetValue replaces the value of the node in place. The key, and therefore
+// the node's position, is unchanged. It panics on nodes of trees created by
+// NewSummed or NewAggregated, whose subtree data depends on the values; use
+// Insert on those instead.
+func (n *Node[K, V]) SetValue(value V) {
+	if n.agg != nil {
+		panic("redblacktrees: SetValue on an augmented tree; use Insert instead")
+	}
+	n.value = value
+}
+
+// ValueOf returns the value of n, or the zero value and false if n is nil,
+// such as the node returned by a failed Search.
+func ValueOf[K cmp.Ordered, V any](n *Node[K, V]) (V, bool) {
+	if n == nil {
+		var value V
+		return value, false
+	}
+	return n.value, true
+}
+
 // Tree represents the root of a red-black tree.
 type Tree[K cmp.Ordered, V any] struct {
 	Root *Node[K, V]
+
+	// OnChange, if non-nil, is called after every insertion of a new key,
+	// replacement of a value, and deletion made through the functions of this
+	// package. It must not modify the tree. Values changed through
+	// Node.SetValue or GetRef, and nodes dropped by Clear, Reset, or
+	// ClearAndZero, are not reported.
+	OnChange func(ChangeEvent[K, V])
+
+	aug   augmenter[K, V]
+	multi bool
+	free  *Node[K, V] // nodes recycled by Reset, linked through right
+}
+
+// ChangeKind identifies the kind of mutation reported by a ChangeEvent.
+type ChangeKind int
+
+const (
+	Inserted ChangeKind = iota // a new key was added; New holds its value
+	Updated                    // the value of a key was replaced; Old and New hold both
+	Deleted                    // a key was removed; Old holds its last value
+)
+
+// ChangeEvent describes a single mutation of a tree, as passed to Tree.OnChange.
+type ChangeEvent[K cmp.Ordered, V any] struct {
+	Kind ChangeKind
+	Key  K
+	Old  V
+	New  V
+}
+
+// Number is a constraint that permits any integer or floating-point type.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
 }
 
 // New returns a new empty Red-Black Tree.
@@ -43,15 +117,167 @@ func New[K cmp.Ordered, V any]() *Tree[K, V] {
 	return &Tree[K, V]{}
 }
 
+// NewMulti returns a new empty Red-Black Tree that keeps duplicate keys.
+// Insert on such a tree always adds a new node, as InsertMulti does.
+// Equal keys are ordered by insertion: a new duplicate is placed after the
+// existing ones, and since rotations preserve in-order position, InOrder
+// yields them first in, first out and Delete removes the earliest one. No
+// per-node sequence number is needed for this.
+func NewMulti[K cmp.Ordered, V any]() *Tree[K, V] {
+	return &Tree[K, V]{multi: true}
+}
+
+// NewSummed returns a new empty Red-Black Tree that maintains the sum of values
+// in every subtree, enabling RangeSum queries in O(log n).
+func NewSummed[K cmp.Ordered, V Number]() *Tree[K, V] {
+	return &Tree[K, V]{aug: summer[K, V]{}}
+}
+
+// NewAggregated returns a new empty Red-Black Tree that maintains, for every
+// subtree, the aggregate of measure(key, value) over its entries, enabling
+// QueryRange in O(log n). combine must be associative with identity as its
+// identity element, but need not be commutative; entries are combined in
+// ascending key order.
+func NewAggregated[K cmp.Ordered, V any, A any](identity A, measure func(K, V) A, combine func(A, A) A) *Tree[K, V] {
+	return &Tree[K, V]{aug: &aggregate[K, V, A]{identity: identity, measure: measure, combine: combine}}
+}
+
+// NewMoments returns a new empty Red-Black Tree that maintains the count, sum,
+// and sum of squares of the values in every subtree, enabling RangeMean and
+// RangeVariance in O(log n). It is a tree created by NewAggregated with
+// aggregate type Moments, so QueryRange can read the raw Moments as well.
+func NewMoments[K cmp.Ordered, V Number]() *Tree[K, V] {
+	return NewAggregated(Moments{}, func(_ K, v V) Moments {
+		f := float64(v)
+		return Moments{Count: 1, Sum: f, SumSq: f * f}
+	}, Moments.add)
+}
+
+// NewIntervals returns a new empty Red-Black Tree for half-open intervals
+// [key, endOf(value)), which maintains the largest interval end in every subtree
+// to answer Overlapping queries. It is built on NewAggregated, so the end is
+// kept up to date by Insert, Delete, and rebalancing alike. As in a tree from
+// New, each start holds a single interval.
+func NewIntervals[K cmp.Ordered, V any](endOf func(V) K) *Tree[K, V] {
+	return NewAggregated(maxEnd[K]{}, func(_ K, v V) maxEnd[K] {
+		return maxEnd[K]{end: endOf(v), ok: true}
+	}, maxEnd[K].max)
+}
+
+// Clone returns a deep copy of t with the same shape and configuration.
+// It runs in O(n); nodes carry parent pointers, so trees cannot share
+// subtrees and every snapshot must copy the whole structure.
+func Clone[K cmp.Ordered, V any](t *Tree[K, V]) *Tree[K, V] {
+	out := emptyLike(t)
+	out.Root = cloneNode(out, t.Root, nil)
+	return out
+}
+
+// Pair is a key-value pair, used to build trees in bulk.
+type Pair[K cmp.Ordered, V any] struct {
+	Key   K
+	Value V
+}
+
+// FromPairs builds a new tree from pairs in any order in O(n log n). When a key
+// occurs more than once, its values are folded in input order: onConflict is
+// called with the value kept so far and the next incoming one, and returns the
+// value to keep. FromPairs returns the tree and the number of conflicts
+// resolved. pairs is left unchanged.
+func FromPairs[K cmp.Ordered, V any](pairs []Pair[K, V], onConflict func(existing, incoming V) V) (*Tree[K, V], int) {
+	sorted := slices.Clone(pairs)
+	slices.SortStableFunc(sorted, func(a, b Pair[K, V]) int { return cmp.Compare(a.Key, b.Key) })
+	nodes := make([]*Node[K, V], 0, len(sorted))
+	conflicts := 0
+	for _, p := range sorted {
+		if last := len(nodes) - 1; last >= 0 && nodes[last].key == p.Key {
+			nodes[last].value = onConflict(nodes[last].value, p.Value)
+			conflicts++
+			continue
+		}
+		nodes = append(nodes, &Node[K, V]{key: p.Key, value: p.Value})
+	}
+	t := New[K, V]()
+	t.Root = buildSorted(t, nodes)
+	return t, conflicts
+}
+
+// CloneSubtree returns a new tree holding a deep copy of the subtree rooted at n,
+// with the same shape and colors except that the new root is black. It runs in
+// O(size of the subtree). A node does not record how its tree was created, so
+// the result is a plain tree as returned by New; a nil n gives an empty tree.
+func CloneSubtree[K cmp.Ordered, V any](n *Node[K, V]) *Tree[K, V] {
+	out := New[K, V]()
+	out.Root = cloneNode(out, n, nil)
+	setColor(out.Root, black)
+	return out
+}
+
+// Rebuild relinks the nodes of t into a tree of minimal height in O(n), using
+// the same sorted build as DeleteAll. Nodes are reused rather than copied, so
+// pointers to them stay valid and keep their keys and values.
+func Rebuild[K cmp.Ordered, V any](t *Tree[K, V]) {
+	nodes := make([]*Node[K, V], 0, Len(t))
+	for n := range InOrderNodes(t) {
+		nodes = append(nodes, n)
+	}
+	t.Root = buildSorted(t, nodes)
+}
+
 // Clear sets the tree root to nil, effectively clearing the tree.
+// Nodes kept for reuse by Reset are released as well, leaving everything to the GC.
 func Clear[K cmp.Ordered, V any](t *Tree[K, V]) {
 	t.Root = nil
+	t.free = nil
+}
+
+// Reset removes all nodes from the tree like Clear, but keeps them on a free list
+// so that later inserts reuse them instead of allocating. Recycled nodes are zeroed,
+// and nodes obtained from the tree before Reset must not be used afterwards.
+func Reset[K cmp.Ordered, V any](t *Tree[K, V]) {
+	dismantle(t.Root, func(n *Node[K, V]) {
+		*n = Node[K, V]{right: t.free}
+		t.free = n
+	})
+	t.Root = nil
+}
+
+// ClearAndZero clears the tree after zeroing every node, including its key, value
+// and links, so that node pointers still held elsewhere do not keep keys, values
+// or the rest of the tree reachable.
+func ClearAndZero[K cmp.Ordered, V any](t *Tree[K, V]) {
+	dismantle(t.Root, func(n *Node[K, V]) {
+		*n = Node[K, V]{}
+	})
+	t.Root = nil
 }
 
 // Insert inserts a new key-value pair into the red-black tree.
-// Returns true if inserted, false if replaced.
+// Returns true if inserted, false if replaced. On a tree created by NewMulti
+// the pair is always inserted.
 func Insert[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) bool {
-	z := &Node[K, V]{key: key, value: value, color: red, size: 1}
+	_, inserted := InsertNode(t, key, value)
+	return inserted
+}
+
+// InsertChecked is like Insert but returns an error, leaving t unchanged, if
+// key is a floating-point NaN. NaN compares neither less than, greater than,
+// nor equal to any key, so inserting one would break the search order.
+func InsertChecked[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) (bool, error) {
+	if key != key {
+		return false, fmt.Errorf("redblacktrees: key %v is NaN", key)
+	}
+	return Insert(t, key, value), nil
+}
+
+// InsertNode is like Insert but also returns the node that now holds key, whether
+// it was newly created or had its value replaced, so that callers can go on to
+// compute its rank or visit its neighbors without searching again. The node
+// stays valid until its key is deleted or the tree is reset or cleared.
+func InsertNode[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) (*Node[K, V], bool) {
+	if t.multi {
+		return insertMulti(t, key, value), true
+	}
 	y := (*Node[K, V])(nil)
 	x := t.Root
 
@@ -63,47 +289,281 @@ func Insert[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) bool {
 		} else if key > x.key {
 			x = x.right
 		} else {
+			old := x.value
 			x.value = value
 			// restore sizes on the path back up
-			for y != nil {
-				updateSize(y)
-				y = y.parent
-			}
-			return false
+			fixSizeUpward(t, y)
+			notify(t, Updated, key, old, value)
+			return x, false
 		}
 	}
 
-	z.parent = y
-	if y == nil {
-		t.Root = z
-	} else if key < y.key {
-		y.left = z
-	} else {
-		y.right = z
+	z := newNode(t, key, value)
+	attach(t, z, y)
+	return z, true
+}
+
+// Update replaces the value of an existing key and reports whether the key was found.
+// Unlike Insert, it never adds a new key.
+func Update[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) bool {
+	n, ok := Search(t, key)
+	if !ok {
+		return false
 	}
-	insertFixup(t, z)
+	old := n.value
+	n.value = value
+	if t.aug != nil {
+		fixSizeUpward(t, n)
+	}
+	notify(t, Updated, key, old, value)
 	return true
 }
 
-// Delete removes a node with the given key from the red-black tree.
-func Delete[K cmp.Ordered, V any](t *Tree[K, V], key K) bool {
-	z := t.Root
-	for z != nil {
-		if key < z.key {
-			z = z.left
-		} else if key > z.key {
-			z = z.right
+// CompareAndSwap sets the value of key to new if the key exists and its current
+// value equals old, and reports whether the value was replaced.
+func CompareAndSwap[K cmp.Ordered, V comparable](t *Tree[K, V], key K, old, new V) bool {
+	n, ok := Search(t, key)
+	if !ok || n.value != old {
+		return false
+	}
+	n.value = new
+	if t.aug != nil {
+		fixSizeUpward(t, n)
+	}
+	notify(t, Updated, key, old, new)
+	return true
+}
+
+// Upsert sets the value of key to f(old, existed) in a single descent, where old is
+// the current value if the key exists and the zero value otherwise. f is called
+// before the tree is changed, so it sees a consistent tree and a panic in f leaves
+// the tree untouched; f must not modify the tree itself. If the key occurs several
+// times, its earliest-inserted occurrence is updated, as Delete would remove.
+func Upsert[K cmp.Ordered, V any](t *Tree[K, V], key K, f func(old V, existed bool) V) {
+	var y, n *Node[K, V]
+	for x := t.Root; x != nil; {
+		if key < x.key {
+			y, x = x, x.left
+		} else if key > x.key {
+			y, x = x, x.right
+		} else {
+			n = x
+			if !t.multi {
+				break
+			}
+			// keep looking left for an earlier duplicate
+			x = x.left
+		}
+	}
+
+	if n != nil {
+		old := n.value
+		n.value = f(old, true)
+		if t.aug != nil {
+			fixSizeUpward(t, n)
+		}
+		notify(t, Updated, key, old, n.value)
+		return
+	}
+	var zero V
+	value := f(zero, false)
+	for p := y; p != nil; p = p.parent {
+		p.size++
+	}
+	attach(t, newNode(t, key, value), y)
+}
+
+// EntryHandle refers to the position of a key in a tree, whether or not the key
+// is present. It is returned by Entry and becomes invalid once the tree is
+// modified other than through the handle itself.
+type EntryHandle[K cmp.Ordered, V any] struct {
+	t      *Tree[K, V]
+	key    K
+	node   *Node[K, V] // node holding key, or nil if the key is absent
+	parent *Node[K, V] // where a new node for key would be attached
+}
+
+// Entry locates key in t with a single descent and returns a handle for
+// inspecting, inserting, or modifying its value without searching again.
+func Entry[K cmp.Ordered, V any](t *Tree[K, V], key K) *EntryHandle[K, V] {
+	e := &EntryHandle[K, V]{t: t, key: key}
+	x := t.Root
+	for x != nil {
+		if key < x.key {
+			e.parent, x = x, x.left
+		} else if key > x.key {
+			e.parent, x = x, x.right
 		} else {
+			e.node = x
 			break
 		}
 	}
+	return e
+}
+
+// Value returns the value of the entry and whether the key is present.
+func (e *EntryHandle[K, V]) Value() (V, bool) {
+	return ValueOf(e.node)
+}
+
+// OrInsert inserts v if the key is absent and returns the entry's value.
+func (e *EntryHandle[K, V]) OrInsert(v V) V {
+	if e.node == nil {
+		for p := e.parent; p != nil; p = p.parent {
+			p.size++
+		}
+		e.node = newNode(e.t, e.key, v)
+		attach(e.t, e.node, e.parent)
+	}
+	return e.node.value
+}
+
+// AndModify calls fn with a pointer to the entry's value if the key is present
+// and returns e for chaining.
+func (e *EntryHandle[K, V]) AndModify(fn func(*V)) *EntryHandle[K, V] {
+	if e.node != nil {
+		old := e.node.value
+		fn(&e.node.value)
+		if e.t.aug != nil {
+			fixSizeUpward(e.t, e.node)
+		}
+		notify(e.t, Updated, e.key, old, e.node.value)
+	}
+	return e
+}
+
+// InsertMulti inserts a new key-value pair even if the key is already present,
+// so that the tree holds one node per insertion. Equal keys are kept in insertion order.
+func InsertMulti[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) {
+	insertMulti(t, key, value)
+}
+
+// insertMulti implements InsertMulti and returns the new node.
+func insertMulti[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) *Node[K, V] {
+	z := newNode(t, key, value)
+	link(t, z)
+	return z
+}
+
+// link adds the detached node z to t after any nodes with an equal key.
+func link[K cmp.Ordered, V any](t *Tree[K, V], z *Node[K, V]) {
+	y := (*Node[K, V])(nil)
+	x := t.Root
+
+	for x != nil {
+		y = x
+		x.size++
+		if z.key < x.key {
+			x = x.left
+		} else {
+			x = x.right
+		}
+	}
+	attach(t, z, y)
+}
+
+// Delete removes a node with the given key from the red-black tree.
+// If the key occurs several times, only its earliest-inserted occurrence is removed.
+func Delete[K cmp.Ordered, V any](t *Tree[K, V], key K) bool {
+	z := firstOf(t, key)
 	if z == nil {
 		return false
 	}
+	DeleteNode(t, z)
+	return true
+}
+
+// DeleteIf removes the node with the given key if pred returns true for its
+// current value, and reports whether a node was removed. If the key occurs
+// several times, only its earliest-inserted occurrence is considered.
+func DeleteIf[K cmp.Ordered, V any](t *Tree[K, V], key K, pred func(value V) bool) bool {
+	z := firstOf(t, key)
+	if z == nil || !pred(z.value) {
+		return false
+	}
+	DeleteNode(t, z)
+	return true
+}
+
+// firstOf returns the earliest-inserted node with the given key, or nil.
+func firstOf[K cmp.Ordered, V any](t *Tree[K, V], key K) *Node[K, V] {
+	var z *Node[K, V]
+	for x := t.Root; x != nil; {
+		if key < x.key {
+			x = x.left
+		} else if key > x.key {
+			x = x.right
+		} else {
+			// keep looking left for an earlier duplicate
+			z = x
+			x = x.left
+		}
+	}
+	return z
+}
+
+// DeleteAll deletes each of the given keys and returns how many nodes were removed.
+// Absent keys are ignored, so a key listed twice is only counted once unless
+// the tree holds duplicates of it. Small batches are deleted one by one; when the
+// batch is large relative to the tree, the keys are sorted and the surviving nodes
+// are relinked in a single O(n) rebuild instead.
+func DeleteAll[K cmp.Ordered, V any](t *Tree[K, V], keys []K) int {
+	n := Len(t)
+	if len(keys)*bits.Len(uint(n)) <= n {
+		removed := 0
+		for _, key := range keys {
+			if Delete(t, key) {
+				removed++
+			}
+		}
+		return removed
+	}
+
+	sorted := slices.Clone(keys)
+	slices.Sort(sorted)
+	kept := make([]*Node[K, V], 0, n)
+	var dropped []*Node[K, V]
+	i := 0
+	for x := range InOrderNodes(t) {
+		for i < len(sorted) && sorted[i] < x.key {
+			i++
+		}
+		if i < len(sorted) && sorted[i] == x.key {
+			// each listed key removes one occurrence
+			i++
+			if t.OnChange != nil {
+				dropped = append(dropped, x)
+			}
+			continue
+		}
+		kept = append(kept, x)
+	}
+	t.Root = buildSorted(t, kept)
+	var zero V
+	for _, x := range dropped {
+		notify(t, Deleted, x.key, x.value, zero)
+	}
+	return n - len(kept)
+}
 
+// DeleteNode removes the node n from the tree without searching for its key.
+// n must currently belong to t; a node already removed, or one obtained before
+// Reset or Clear, must not be passed. Other nodes stay valid across the removal.
+// A nil n is ignored.
+func DeleteNode[K cmp.Ordered, V any](t *Tree[K, V], n *Node[K, V]) {
+	if n == nil {
+		return
+	}
+	z := n
 	y := z
 	yOriginalColor := y.color
 	var x *Node[K, V]
+	// xParent is x's parent once z is unlinked, the lowest node whose subtree
+	// lost a node; x itself may be nil, so it cannot be reached through x.
+	// Sizes are restored from here rather than from z.parent: when the
+	// successor is taken from deeper in z's right subtree, its old ancestors
+	// below z shrink too.
+	xParent := z.parent
 
 	if z.left == nil {
 		x = z.right
@@ -116,10 +576,12 @@ func Delete[K cmp.Ordered, V any](t *Tree[K, V], key K) bool {
 		yOriginalColor = y.color
 		x = y.right
 		if y.parent == z {
+			xParent = y
 			if x != nil {
 				x.parent = y
 			}
 		} else {
+			xParent = y.parent
 			transplant(t, y, y.right)
 			y.right = z.right
 			if y.right != nil {
@@ -132,13 +594,171 @@ func Delete[K cmp.Ordered, V any](t *Tree[K, V], key K) bool {
 			y.left.parent = y
 		}
 		y.color = z.color
-		updateSize(y)
 	}
-	fixSizeUpward(z.parent)
+	fixSizeUpward(t, xParent)
 	if yOriginalColor == black {
-		deleteFixup(t, x, z.parent)
+		deleteFixup(t, x, xParent)
+	}
+	var zero V
+	notify(t, Deleted, n.key, n.value, zero)
+}
+
+// RetainRange removes every node whose key is outside [from, to) and returns
+// the number of nodes removed.
+func RetainRange[K cmp.Ordered, V any](t *Tree[K, V], from, to K) int {
+	removed := 0
+	for n, ok := Min(t); ok && n.key < from; n, ok = Min(t) {
+		DeleteNode(t, n)
+		removed++
+	}
+	for n, ok := Max(t); ok && n.key >= to; n, ok = Max(t) {
+		DeleteNode(t, n)
+		removed++
+	}
+	return removed
+}
+
+// DeleteMin removes the node with the minimum key and returns its entry.
+// On a tree created by NewMulti the earliest-inserted of the equal keys is removed.
+func DeleteMin[K cmp.Ordered, V any](t *Tree[K, V]) (K, V, bool) {
+	n, ok := Min(t)
+	key, value, ok := entryOf(n, ok)
+	DeleteNode(t, n)
+	return key, value, ok
+}
+
+// DeleteMax removes the node with the maximum key and returns its entry.
+// On a tree created by NewMulti the latest-inserted of the equal keys is removed.
+func DeleteMax[K cmp.Ordered, V any](t *Tree[K, V]) (K, V, bool) {
+	n, ok := Max(t)
+	key, value, ok := entryOf(n, ok)
+	DeleteNode(t, n)
+	return key, value, ok
+}
+
+// Evict selects which end of a Capped tree loses an entry on overflow.
+type Evict int
+
+const (
+	EvictMax Evict = iota // drop the largest key, keeping the smallest N
+	EvictMin              // drop the smallest key, keeping the largest N
+)
+
+// Capped is a tree that holds at most a fixed number of entries. Inserting a
+// new key into a full Capped tree evicts the maximum or minimum key, as chosen
+// by its Evict policy, which may be the key just inserted. Inserting a key that
+// is already present only replaces its value and never evicts.
+type Capped[K cmp.Ordered, V any] struct {
+	tree     *Tree[K, V]
+	capacity int
+	evict    Evict
+}
+
+// NewCapped creates an empty Capped tree holding at most capacity entries.
+// It panics if capacity is not positive.
+func NewCapped[K cmp.Ordered, V any](capacity int, evict Evict) *Capped[K, V] {
+	if capacity <= 0 {
+		panic("redblacktrees: NewCapped requires a positive capacity")
+	}
+	return &Capped[K, V]{tree: New[K, V](), capacity: capacity, evict: evict}
+}
+
+// Tree returns the underlying tree for read-only queries such as Search,
+// InOrder, or Kth. Inserting into it directly bypasses the capacity bound.
+func (c *Capped[K, V]) Tree() *Tree[K, V] {
+	return c.tree
+}
+
+// Insert inserts or updates key and, if the tree then exceeds its capacity,
+// evicts one entry according to the Evict policy and returns it.
+func (c *Capped[K, V]) Insert(key K, value V) (evictedKey K, evictedValue V, evicted bool) {
+	Insert(c.tree, key, value)
+	if Len(c.tree) <= c.capacity {
+		return evictedKey, evictedValue, false
+	}
+	if c.evict == EvictMin {
+		return DeleteMin(c.tree)
+	}
+	return DeleteMax(c.tree)
+}
+
+// TimeTree is a tree keyed by time.Time, which is not cmp.Ordered. Times are
+// ordered as by time.Time.Compare, so two times for the same instant in
+// different locations are the same key. Each entry keeps the time.Time it was
+// last inserted with, including its location and monotonic reading. Any
+// time.Time, including the zero time, can be used as a key.
+type TimeTree[V any] struct {
+	tree *Tree[string, timeEntry[V]]
+}
+
+type timeEntry[V any] struct {
+	at    time.Time
+	value V
+}
+
+// NewTimeTree returns a new empty TimeTree.
+func NewTimeTree[V any]() *TimeTree[V] {
+	return &TimeTree[V]{tree: New[string, timeEntry[V]]()}
+}
+
+// timeKey encodes at as a string whose byte order is chronological over the
+// whole range of time.Time: the Unix seconds with the sign bit flipped, then
+// the nanoseconds, both big-endian. UnixNano would overflow outside the years
+// 1678 to 2262.
+func timeKey(at time.Time) string {
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(at.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(b[8:], uint32(at.Nanosecond()))
+	return string(b[:])
+}
+
+// Insert inserts or replaces the value at the given time and reports whether
+// the time was new.
+func (t *TimeTree[V]) Insert(at time.Time, value V) bool {
+	return Insert(t.tree, timeKey(at), timeEntry[V]{at, value})
+}
+
+// Search returns the value at the given time and whether it is present.
+func (t *TimeTree[V]) Search(at time.Time) (V, bool) {
+	n, ok := Search(t.tree, timeKey(at))
+	if !ok {
+		var value V
+		return value, false
+	}
+	return n.value.value, true
+}
+
+// Delete removes the entry at the given time and reports whether it was present.
+func (t *TimeTree[V]) Delete(at time.Time) bool {
+	return Delete(t.tree, timeKey(at))
+}
+
+// Len returns the number of entries in the tree.
+func (t *TimeTree[V]) Len() int {
+	return Len(t.tree)
+}
+
+// All returns an iterator over all entries in chronological order.
+func (t *TimeTree[V]) All() iter.Seq2[time.Time, V] {
+	return func(yield func(time.Time, V) bool) {
+		for n := range InOrder(t.tree) {
+			if !yield(n.value.at, n.value.value) {
+				return
+			}
+		}
+	}
+}
+
+// Range returns an iterator over the entries with times in [from, to) in
+// chronological order. The iterator is empty if from is not before to.
+func (t *TimeTree[V]) Range(from, to time.Time) iter.Seq2[time.Time, V] {
+	return func(yield func(time.Time, V) bool) {
+		for n := range Range(t.tree, timeKey(from), timeKey(to)) {
+			if !yield(n.value.at, n.value.value) {
+				return
+			}
+		}
 	}
-	return true
 }
 
 // Search finds a node with the given key in the red-black tree.
@@ -156,6 +776,61 @@ func Search[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
 	return nil, false
 }
 
+// ValueOr returns the value stored for key, or fallback if the key is absent.
+func ValueOr[K cmp.Ordered, V any](t *Tree[K, V], key K, fallback V) V {
+	if n, ok := Search(t, key); ok {
+		return n.value
+	}
+	return fallback
+}
+
+// GetRef returns a pointer to the value stored for key, allowing large values to be
+// modified in place. The pointer refers into the node and must not be used after
+// the key is deleted or the tree is reset. Values of trees created by NewSummed or
+// NewAggregated must not be modified through it, since their subtree data would go stale.
+func GetRef[K cmp.Ordered, V any](t *Tree[K, V], key K) (*V, bool) {
+	n, ok := Search(t, key)
+	if !ok {
+		return nil, false
+	}
+	return &n.value, true
+}
+
+// Depth returns the number of edges between the root and the node with the given key.
+func Depth[K cmp.Ordered, V any](t *Tree[K, V], key K) (int, bool) {
+	depth := 0
+	x := t.Root
+	for x != nil {
+		if key < x.key {
+			x = x.left
+		} else if key > x.key {
+			x = x.right
+		} else {
+			return depth, true
+		}
+		depth++
+	}
+	return 0, false
+}
+
+// Path returns the nodes visited from the root down to the node with the given key.
+// If the key is absent, the partial path of nodes visited is returned along with false.
+func Path[K cmp.Ordered, V any](t *Tree[K, V], key K) ([]*Node[K, V], bool) {
+	var path []*Node[K, V]
+	x := t.Root
+	for x != nil {
+		path = append(path, x)
+		if key < x.key {
+			x = x.left
+		} else if key > x.key {
+			x = x.right
+		} else {
+			return path, true
+		}
+	}
+	return path, false
+}
+
 // Min returns the node with the minimum key in the tree.
 func Min[K cmp.Ordered, V any](t *Tree[K, V]) (*Node[K, V], bool) {
 	if t.Root == nil {
@@ -176,6 +851,16 @@ func Max[K cmp.Ordered, V any](t *Tree[K, V]) (*Node[K, V], bool) {
 	return n, true
 }
 
+// First returns the node with the minimum key in the tree. It is the same as Min.
+func First[K cmp.Ordered, V any](t *Tree[K, V]) (*Node[K, V], bool) {
+	return Min(t)
+}
+
+// Last returns the node with the maximum key in the tree. It is the same as Max.
+func Last[K cmp.Ordered, V any](t *Tree[K, V]) (*Node[K, V], bool) {
+	return Max(t)
+}
+
 // Ceiling returns the node with the smallest key greater than or equal to the given key.
 func Ceiling[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
 	curr := t.Root
@@ -190,188 +875,1723 @@ func Ceiling[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
 			curr = curr.right
 		}
 	}
-	return result, result != nil
+	return result, result != nil
+}
+
+// Floor returns the node with the greatest key less than or equal to the given key.
+func Floor[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
+	curr := t.Root
+	var result *Node[K, V]
+	for curr != nil {
+		if key == curr.key {
+			return curr, true
+		} else if key < curr.key {
+			curr = curr.left
+		} else {
+			result = curr
+			curr = curr.right
+		}
+	}
+	return result, result != nil
+}
+
+// Bracket returns both the Floor and the Ceiling of the given key in a single
+// descent. If a node has exactly the given key, it is returned as both.
+func Bracket[K cmp.Ordered, V any](t *Tree[K, V], key K) (floor, ceiling *Node[K, V], hasFloor, hasCeiling bool) {
+	curr := t.Root
+	for curr != nil {
+		if key == curr.key {
+			return curr, curr, true, true
+		} else if key < curr.key {
+			ceiling = curr
+			curr = curr.left
+		} else {
+			floor = curr
+			curr = curr.right
+		}
+	}
+	return floor, ceiling, floor != nil, ceiling != nil
+}
+
+// NearestN returns up to n nodes whose keys are closest to key, ordered by
+// increasing distance. On equal distances the smaller key comes first. It walks
+// outward from the floor and ceiling of key in O(log n + n) time and returns
+// every node, nearest first, if n exceeds the size of the tree.
+func NearestN[K Number, V any](t *Tree[K, V], key K, n int) []*Node[K, V] {
+	if n <= 0 {
+		return nil
+	}
+	// split by rank rather than Floor and Higher so that on trees created by
+	// NewMulti every duplicate of key lies on the lower side
+	r := rankUpper(t, key)
+	lo, _ := Kth(t, r-1)
+	hi, _ := Kth(t, r)
+	nodes := make([]*Node[K, V], 0, min(n, Len(t)))
+	for len(nodes) < n && (lo != nil || hi != nil) {
+		if hi == nil || (lo != nil && nearerLow(lo.key, key, hi.key)) {
+			nodes = append(nodes, lo)
+			lo, _ = Predecessor(lo)
+		} else {
+			nodes = append(nodes, hi)
+			hi, _ = Successor(hi)
+		}
+	}
+	return nodes
+}
+
+// nearerLow reports whether lo is at least as near to key as hi, where
+// lo <= key <= hi. Integer distances are taken in uint64, which holds the
+// difference of any two integers of the same type, so that keys near the
+// limits of a signed type do not overflow. A float distance that overflows
+// becomes +Inf, which still compares correctly.
+func nearerLow[K Number](lo, key, hi K) bool {
+	if one := K(1); one/2 == 0 {
+		return uint64(key)-uint64(lo) <= uint64(hi)-uint64(key)
+	}
+	return key-lo <= hi-key
+}
+
+// Higher returns the node with the smallest key greater than the given key.
+func Higher[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
+	curr := t.Root
+	var result *Node[K, V]
+	for curr != nil {
+		if key < curr.key {
+			result = curr
+			curr = curr.left
+		} else {
+			curr = curr.right
+		}
+	}
+	return result, result != nil
+}
+
+// Lower returns the node with the greatest key less than the given key.
+func Lower[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
+	curr := t.Root
+	var result *Node[K, V]
+	for curr != nil {
+		if key <= curr.key {
+			curr = curr.left
+		} else {
+			result = curr
+			curr = curr.right
+		}
+	}
+	return result, result != nil
+}
+
+// Predecessor returns the in-order predecessor node of n, if any.
+func Predecessor[K cmp.Ordered, V any](n *Node[K, V]) (*Node[K, V], bool) {
+	if n.left != nil {
+		x := n.left
+		for x.right != nil {
+			x = x.right
+		}
+		return x, true
+	}
+	p := n.parent
+	for p != nil && n == p.left {
+		n = p
+		p = p.parent
+	}
+	return p, p != nil
+}
+
+// Successor returns the in-order successor node of n, if any.
+func Successor[K cmp.Ordered, V any](n *Node[K, V]) (*Node[K, V], bool) {
+	if n.right != nil {
+		x := n.right
+		for x.left != nil {
+			x = x.left
+		}
+		return x, true
+	}
+	p := n.parent
+	for p != nil && n == p.right {
+		n = p
+		p = p.parent
+	}
+	return p, p != nil
+}
+
+// SuccessorOf returns the entry with the smallest key strictly greater than key.
+// key need not be present: if it is, this is the entry of its in-order successor,
+// and if it is not, this is the same entry Higher returns.
+func SuccessorOf[K cmp.Ordered, V any](t *Tree[K, V], key K) (K, V, bool) {
+	return entryOf(Higher(t, key))
+}
+
+// PredecessorOf returns the entry with the greatest key strictly less than key.
+// key need not be present: if it is, this is the entry of its in-order predecessor,
+// and if it is not, this is the same entry Lower returns.
+func PredecessorOf[K cmp.Ordered, V any](t *Tree[K, V], key K) (K, V, bool) {
+	return entryOf(Lower(t, key))
+}
+
+// InOrder returns an iterator for in-order traversal of the tree.
+func InOrder[K cmp.Ordered, V any](t *Tree[K, V]) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		var stack []*Node[K, V]
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil {
+				stack = append(stack, curr)
+				curr = curr.left
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !yield(*n) {
+				return
+			}
+			curr = n.right
+		}
+	}
+}
+
+// SubtreeInOrder returns an iterator for in-order traversal of the subtree rooted
+// at n. It follows only child links, so n's parent and siblings are never visited.
+// A nil n yields nothing.
+func SubtreeInOrder[K cmp.Ordered, V any](n *Node[K, V]) iter.Seq[Node[K, V]] {
+	return InOrder(&Tree[K, V]{Root: n})
+}
+
+// InOrderNodes returns an iterator over the live nodes of the tree in order.
+// Values may be changed through SetValue during the iteration, but keys must
+// not be changed and the tree must not be modified.
+func InOrderNodes[K cmp.Ordered, V any](t *Tree[K, V]) iter.Seq[*Node[K, V]] {
+	return func(yield func(*Node[K, V]) bool) {
+		var stack []*Node[K, V]
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil {
+				stack = append(stack, curr)
+				curr = curr.left
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !yield(n) {
+				return
+			}
+			curr = n.right
+		}
+	}
+}
+
+// InOrderNoAlloc is like InOrder but walks the tree in O(1) extra space by
+// following parent links instead of keeping a stack, so a traversal allocates
+// nothing beyond the iterator itself. Unlike a Morris traversal it never
+// rewires the tree, so concurrent readers and early termination are safe.
+// Each step costs amortized O(1) but touches more nodes than InOrder.
+func InOrderNoAlloc[K cmp.Ordered, V any](t *Tree[K, V]) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		for n, ok := Min(t); ok; n, ok = Successor(n) {
+			if !yield(*n) {
+				return
+			}
+		}
+	}
+}
+
+// InOrderInto appends the nodes of the tree in order to buf and returns the
+// extended slice, like append. Passing buf[:0] from a previous call reuses its
+// capacity, so repeated scans of a tree that has not grown allocate nothing.
+func InOrderInto[K cmp.Ordered, V any](t *Tree[K, V], buf []Node[K, V]) []Node[K, V] {
+	buf = slices.Grow(buf, Len(t))
+	for n, ok := Min(t); ok; n, ok = Successor(n) {
+		buf = append(buf, *n)
+	}
+	return buf
+}
+
+// Collect maps each entry of the tree, in ascending key order, through fn and
+// returns the results as a slice sized to Len up front.
+func Collect[K cmp.Ordered, V, T any](t *Tree[K, V], fn func(K, V) T) []T {
+	out := make([]T, 0, Len(t))
+	for n, ok := Min(t); ok; n, ok = Successor(n) {
+		out = append(out, fn(n.key, n.value))
+	}
+	return out
+}
+
+// EnumerateInOrder returns an iterator over the nodes of the tree in order,
+// paired with their 0-based in-order index, which is also their rank.
+func EnumerateInOrder[K cmp.Ordered, V any](t *Tree[K, V]) iter.Seq2[int, Node[K, V]] {
+	return func(yield func(int, Node[K, V]) bool) {
+		i := 0
+		for n := range InOrder(t) {
+			if !yield(i, n) {
+				return
+			}
+			i++
+		}
+	}
+}
+
+// TakeWhile returns an iterator over the nodes in ascending order that stops at
+// the first node for which pred returns false.
+func TakeWhile[K cmp.Ordered, V any](t *Tree[K, V], pred func(K, V) bool) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		for n := range InOrder(t) {
+			if !pred(n.key, n.value) || !yield(n) {
+				return
+			}
+		}
+	}
+}
+
+// DropWhile returns an iterator over the nodes in ascending order that skips
+// nodes while pred returns true and yields every node from the first failure on.
+func DropWhile[K cmp.Ordered, V any](t *Tree[K, V], pred func(K, V) bool) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		dropping := true
+		for n := range InOrder(t) {
+			if dropping && pred(n.key, n.value) {
+				continue
+			}
+			dropping = false
+			if !yield(n) {
+				return
+			}
+		}
+	}
+}
+
+// Order selects the traversal order used by Walk.
+type Order int
+
+const (
+	// Ascending visits nodes in ascending key order (in-order).
+	Ascending Order = iota
+	// Descending visits nodes in descending key order (reverse in-order).
+	Descending
+	// PreOrder visits each node before its left and right subtrees.
+	PreOrder
+	// PostOrder visits each node after its left and right subtrees.
+	PostOrder
+)
+
+// Visitor is called by Walk for each node. Returning false stops the walk.
+type Visitor[K cmp.Ordered, V any] interface {
+	Visit(n *Node[K, V]) bool
+}
+
+// VisitorFunc adapts an ordinary function to the Visitor interface.
+type VisitorFunc[K cmp.Ordered, V any] func(n *Node[K, V]) bool
+
+// Visit calls f(n).
+func (f VisitorFunc[K, V]) Visit(n *Node[K, V]) bool {
+	return f(n)
+}
+
+// Walk visits the nodes of the tree in the given order until v returns false.
+// As with InOrderNodes, v may change values but must not modify the tree.
+func Walk[K cmp.Ordered, V any](t *Tree[K, V], order Order, v Visitor[K, V]) {
+	var stack []*Node[K, V]
+	switch order {
+	case Ascending, Descending:
+		near := func(n *Node[K, V]) *Node[K, V] { return n.left }
+		far := func(n *Node[K, V]) *Node[K, V] { return n.right }
+		if order == Descending {
+			near, far = far, near
+		}
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil {
+				stack = append(stack, curr)
+				curr = near(curr)
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !v.Visit(n) {
+				return
+			}
+			curr = far(n)
+		}
+	case PreOrder:
+		if t.Root != nil {
+			stack = append(stack, t.Root)
+		}
+		for len(stack) > 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !v.Visit(n) {
+				return
+			}
+			if n.right != nil {
+				stack = append(stack, n.right)
+			}
+			if n.left != nil {
+				stack = append(stack, n.left)
+			}
+		}
+	case PostOrder:
+		var last *Node[K, V]
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil {
+				stack = append(stack, curr)
+				curr = curr.left
+			}
+			n := stack[len(stack)-1]
+			if n.right != nil && n.right != last {
+				curr = n.right
+				continue
+			}
+			stack = stack[:len(stack)-1]
+			if !v.Visit(n) {
+				return
+			}
+			last = n
+		}
+	default:
+		panic("redblacktrees: unknown traversal order")
+	}
+}
+
+// EulerVisitor holds the callbacks used by WalkEuler. Any of them may be nil.
+// Pre is called when a node is first reached, In between its left and right
+// subtrees, and Post after both. Returning false from Pre skips the node's
+// subtrees along with its In and Post calls; from In, skips its right subtree
+// but still calls Post; from Post, stops the walk.
+type EulerVisitor[K cmp.Ordered, V any] struct {
+	Pre  func(n *Node[K, V]) bool
+	In   func(n *Node[K, V]) bool
+	Post func(n *Node[K, V]) bool
+}
+
+// WalkEuler makes a single depth-first pass over the tree, calling the
+// callbacks of v at each phase of every node. It combines the pre-, in-, and
+// post-order walks of Walk, for code that needs both the shape and the order of
+// the tree. As with Walk, the callbacks may change values but must not modify
+// the tree.
+func WalkEuler[K cmp.Ordered, V any](t *Tree[K, V], v EulerVisitor[K, V]) {
+	type frame struct {
+		n     *Node[K, V]
+		phase int
+	}
+	if t.Root == nil {
+		return
+	}
+	stack := []frame{{t.Root, 0}}
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		n := f.n
+		switch f.phase {
+		case 0:
+			f.phase = 1
+			if v.Pre != nil && !v.Pre(n) {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			if n.left != nil {
+				stack = append(stack, frame{n.left, 0})
+			}
+		case 1:
+			f.phase = 2
+			if v.In != nil && !v.In(n) {
+				continue
+			}
+			if n.right != nil {
+				stack = append(stack, frame{n.right, 0})
+			}
+		default:
+			stack = stack[:len(stack)-1]
+			if v.Post != nil && !v.Post(n) {
+				return
+			}
+		}
+	}
+}
+
+// Range returns an iterator over nodes with keys in [from, to).
+// The iterator is empty if from >= to.
+func Range[K cmp.Ordered, V any](t *Tree[K, V], from, to K) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		if from >= to {
+			return
+		}
+		var stack []*Node[K, V]
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil {
+				stack = append(stack, curr)
+				curr = curr.left
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if n.key >= from && n.key < to {
+				if !yield(*n) {
+					return
+				}
+			}
+			if n.key >= to {
+				curr = nil
+			} else {
+				curr = n.right
+			}
+		}
+	}
+}
+
+// Between returns an iterator over nodes with keys between from and to in
+// ascending order, where incFrom and incTo choose whether each endpoint is
+// included. Subtrees lying entirely outside the bounds are skipped.
+// The iterator is empty if from > to, or if from == to and either end is open.
+func Between[K cmp.Ordered, V any](t *Tree[K, V], from, to K, incFrom, incTo bool) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		var stack []*Node[K, V]
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil {
+				if curr.key > from || (incFrom && curr.key == from) {
+					stack = append(stack, curr)
+					curr = curr.left
+				} else {
+					curr = curr.right
+				}
+			}
+			if len(stack) == 0 {
+				return
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if n.key > to || (!incTo && n.key == to) {
+				return
+			}
+			if !yield(*n) {
+				return
+			}
+			curr = n.right
+		}
+	}
+}
+
+// RangeReverse returns an iterator over nodes with keys in [from, to) in
+// descending order. Subtrees lying entirely outside the range are skipped.
+// The iterator is empty if from >= to.
+func RangeReverse[K cmp.Ordered, V any](t *Tree[K, V], from, to K) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		var stack []*Node[K, V]
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil {
+				if curr.key < to {
+					stack = append(stack, curr)
+					curr = curr.right
+				} else {
+					curr = curr.left
+				}
+			}
+			if len(stack) == 0 {
+				return
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if n.key < from {
+				return
+			}
+			if !yield(*n) {
+				return
+			}
+			curr = n.left
+		}
+	}
+}
+
+// RangePage returns an iterator over nodes with keys in [from, to), skipping the
+// first offset matches and yielding at most limit nodes. The first node is located
+// through its rank in O(log n) instead of iterating over the skipped prefix.
+// The iterator is empty if offset exceeds the number of matches; a negative limit
+// means no limit and a negative offset is treated as 0.
+func RangePage[K cmp.Ordered, V any](t *Tree[K, V], from, to K, offset, limit int) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		if from >= to {
+			return
+		}
+		n, ok := Kth(t, Rank(t, from)+max(offset, 0))
+		for count := 0; ok && n.key < to && count != limit; count++ {
+			if !yield(*n) {
+				return
+			}
+			n, ok = Successor(n)
+		}
+	}
+}
+
+// RangeSlice returns the nodes with keys in [from, to) in ascending order, as a
+// slice sized up front with CountRange. The slice is empty if from >= to.
+func RangeSlice[K cmp.Ordered, V any](t *Tree[K, V], from, to K) []Node[K, V] {
+	nodes := make([]Node[K, V], 0, CountRange(t, from, to))
+	for n := range Range(t, from, to) {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// SplitRanges divides the keys of t into at most n contiguous chunks of nearly
+// equal size, located by rank in O(n log n), and returns the first and last key
+// of each chunk in ascending order. The bounds are inclusive, so each chunk can
+// be scanned with Between(t, first, last, true, true); together the chunks cover
+// every key without overlap. All occurrences of a key on a tree created by
+// NewMulti fall in the same chunk, which may leave fewer than n chunks. It
+// returns nil if the tree is empty or n <= 0.
+func SplitRanges[K cmp.Ordered, V any](t *Tree[K, V], n int) [][2]K {
+	size := Len(t)
+	n = min(n, size)
+	if n <= 0 {
+		return nil
+	}
+	pairs := make([][2]K, 0, n)
+	start := 0
+	for i := 1; i <= n && start < size; i++ {
+		end := i * size / n
+		if end <= start {
+			continue
+		}
+		first, _ := Kth(t, start)
+		last, _ := Kth(t, end-1)
+		pairs = append(pairs, [2]K{first.key, last.key})
+		// move every duplicate of the last key into this chunk
+		start = rankUpper(t, last.key)
+	}
+	return pairs
+}
+
+// RangePrefix returns an iterator over the nodes whose keys start with prefix,
+// in ascending order. It is Range over [prefix, end), where end is prefix with
+// its last byte below 0xff incremented and any 0xff bytes after it dropped.
+// If prefix is empty or consists only of 0xff bytes, there is no upper bound.
+func RangePrefix[V any](t *Tree[string, V], prefix string) iter.Seq[Node[string, V]] {
+	return func(yield func(Node[string, V]) bool) {
+		if end, ok := prefixEnd(prefix); ok {
+			for n := range Range(t, prefix, end) {
+				if !yield(n) {
+					return
+				}
+			}
+			return
+		}
+		for n, ok := Ceiling(t, prefix); ok; n, ok = Successor(n) {
+			if !yield(*n) {
+				return
+			}
+		}
+	}
+}
+
+// prefixEnd returns the smallest string greater than every string starting
+// with prefix, or false if there is none.
+func prefixEnd(prefix string) (string, bool) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1}), true
+		}
+	}
+	return "", false
+}
+
+// FirstN returns an iterator over the n nodes with the smallest keys, in ascending order.
+// It yields every node if n exceeds the size of the tree and nothing if n <= 0.
+func FirstN[K cmp.Ordered, V any](t *Tree[K, V], n int) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		if t.Root == nil || n <= 0 {
+			return
+		}
+		x := minimum(t.Root)
+		for i := 0; i < n; i++ {
+			if !yield(*x) {
+				return
+			}
+			var ok bool
+			if x, ok = Successor(x); !ok {
+				return
+			}
+		}
+	}
+}
+
+// LastN returns an iterator over the n nodes with the largest keys.
+// The nodes are yielded in ascending order, starting from the one found by rank.
+// It yields every node if n exceeds the size of the tree and nothing if n <= 0.
+func LastN[K cmp.Ordered, V any](t *Tree[K, V], n int) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		if n <= 0 {
+			return
+		}
+		x, ok := Kth(t, max(Len(t)-n, 0))
+		for ok {
+			if !yield(*x) {
+				return
+			}
+			x, ok = Successor(x)
+		}
+	}
+}
+
+// FromRank returns an iterator over the nodes in ascending order starting at
+// the given 0-based rank (k), located in O(log n). A k <= 0 starts at the
+// smallest key and a k >= Len yields nothing.
+func FromRank[K cmp.Ordered, V any](t *Tree[K, V], k int) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		for n, ok := Kth(t, max(k, 0)); ok; n, ok = Successor(n) {
+			if !yield(*n) {
+				return
+			}
+		}
+	}
+}
+
+// FromDescending returns an iterator over the nodes in descending order starting
+// at the largest key less than or equal to start, which need not be present.
+// On a tree created by NewMulti it starts at the last of several equal keys.
+func FromDescending[K cmp.Ordered, V any](t *Tree[K, V], start K) iter.Seq[Node[K, V]] {
+	return func(yield func(Node[K, V]) bool) {
+		var n *Node[K, V]
+		for curr := t.Root; curr != nil; {
+			if curr.key <= start {
+				n = curr
+				curr = curr.right
+			} else {
+				curr = curr.left
+			}
+		}
+		for ok := n != nil; ok; n, ok = Predecessor(n) {
+			if !yield(*n) {
+				return
+			}
+		}
+	}
+}
+
+// Rank returns the number of nodes with keys less than the given key.
+func Rank[K cmp.Ordered, V any](t *Tree[K, V], key K) int {
+	rank := 0
+	curr := t.Root
+	for curr != nil {
+		// equal keys may sit on either side of a node holding key, so keep descending left
+		if key <= curr.key {
+			curr = curr.left
+		} else {
+			rank += sizeOf(curr.left) + 1
+			curr = curr.right
+		}
+	}
+	return rank
+}
+
+// RankOfNode returns the 0-based in-order rank of n within its tree.
+// It walks up the parent pointers, adding the size of every left subtree
+// passed on the way, so it runs in O(log n) without comparing keys.
+func RankOfNode[K cmp.Ordered, V any](n *Node[K, V]) int {
+	rank := sizeOf(n.left)
+	for n.parent != nil {
+		if n == n.parent.right {
+			rank += sizeOf(n.parent.left) + 1
+		}
+		n = n.parent
+	}
+	return rank
+}
+
+// CountLess returns the number of nodes with keys strictly less than the given key.
+// It is equivalent to Rank.
+func CountLess[K cmp.Ordered, V any](t *Tree[K, V], key K) int {
+	return Rank(t, key)
+}
+
+// CountGreater returns the number of nodes with keys strictly greater than the given key.
+func CountGreater[K cmp.Ordered, V any](t *Tree[K, V], key K) int {
+	return Len(t) - rankUpper(t, key)
+}
+
+// RankRange returns the rank of the first key greater than or equal to from
+// and the number of keys in [from, to).
+func RankRange[K cmp.Ordered, V any](t *Tree[K, V], from, to K) (startRank, count int) {
+	startRank = Rank(t, from)
+	if from < to {
+		count = Rank(t, to) - startRank
+	}
+	return startRank, count
+}
+
+// AnyInRange reports whether any key lies in [from, to). It stops at the first
+// node found in the range, so it does at most one descent.
+func AnyInRange[K cmp.Ordered, V any](t *Tree[K, V], from, to K) bool {
+	return splitNode(t, from, to) != nil
+}
+
+// KthInRange returns the node with the given 0-based rank (k) among the keys in
+// [from, to), in O(log n). It returns false if k is negative or not less than the
+// number of keys in the range.
+func KthInRange[K cmp.Ordered, V any](t *Tree[K, V], from, to K, k int) (*Node[K, V], bool) {
+	start, count := RankRange(t, from, to)
+	if k < 0 || k >= count {
+		return nil, false
+	}
+	return Kth(t, start+k)
+}
+
+// CountRange returns the number of nodes with keys in [from, to) in O(log n).
+func CountRange[K cmp.Ordered, V any](t *Tree[K, V], from, to K) int {
+	if from >= to {
+		return 0
+	}
+	return Rank(t, to) - Rank(t, from)
+}
+
+// Count returns the number of nodes with the given key.
+// It is at most 1 unless the tree holds duplicates from InsertMulti or NewMulti.
+func Count[K cmp.Ordered, V any](t *Tree[K, V], key K) int {
+	return rankUpper(t, key) - Rank(t, key)
+}
+
+// Kth returns the node with the given 0-based rank (k).
+func Kth[K cmp.Ordered, V any](t *Tree[K, V], k int) (*Node[K, V], bool) {
+	curr := t.Root
+	for curr != nil {
+		leftSize := 0
+		if curr.left != nil {
+			leftSize = curr.left.size
+		}
+		if k < leftSize {
+			curr = curr.left
+		} else if k > leftSize {
+			k -= leftSize + 1
+			curr = curr.right
+		} else {
+			return curr, true
+		}
+	}
+	return nil, false
+}
+
+// Select is like Kth but returns an error describing the problem when k is
+// out of range.
+func Select[K cmp.Ordered, V any](t *Tree[K, V], k int) (*Node[K, V], error) {
+	n, ok := Kth(t, k)
+	if !ok {
+		return nil, fmt.Errorf("redblacktrees: rank %d out of range for tree of size %d", k, Len(t))
+	}
+	return n, nil
+}
+
+// SelectEntry returns the key and value with the given 0-based rank (k).
+func SelectEntry[K cmp.Ordered, V any](t *Tree[K, V], k int) (K, V, bool) {
+	return entryOf(Kth(t, k))
+}
+
+// Quantile returns the key and value at fractional position q in [0, 1].
+// The position maps to the 0-based rank floor(q*(Len-1)), so 0 selects the
+// minimum and 1 the maximum. It returns false if the tree is empty or q is out of range.
+func Quantile[K cmp.Ordered, V any](t *Tree[K, V], q float64) (K, V, bool) {
+	if !(q >= 0 && q <= 1) || t.Root == nil {
+		var key K
+		var value V
+		return key, value, false
+	}
+	return SelectEntry(t, int(q*float64(Len(t)-1)))
+}
+
+// Len returns the number of nodes in the tree.
+func Len[K cmp.Ordered, V any](t *Tree[K, V]) int {
+	if t.Root == nil {
+		return 0
+	}
+	return t.Root.size
+}
+
+// ApproxBytes estimates the memory used by the tree as the size of the Tree
+// header plus Len(t) times the size of a node, which includes the inline size
+// of K and V. Memory referenced by keys or values, such as string or slice
+// backing arrays, subtree data kept by augmented trees, and nodes retained for
+// reuse after Reset are not counted. It is a rough gauge, not exact accounting.
+func ApproxBytes[K cmp.Ordered, V any](t *Tree[K, V]) int {
+	return int(unsafe.Sizeof(*t)) + Len(t)*int(unsafe.Sizeof(Node[K, V]{}))
+}
+
+// TreeStats describes the shape of a tree. Depths count edges from the root, and
+// a leaf is a node with no children.
+type TreeStats[K cmp.Ordered] struct {
+	Size         int     // number of nodes
+	MinKey       K       // smallest key
+	MaxKey       K       // largest key
+	Height       int     // number of nodes on the longest root-to-leaf path
+	BlackHeight  int     // number of black nodes on every root-to-leaf path
+	RedNodes     int     // number of red nodes
+	AvgDepth     float64 // mean depth of all nodes, the root being at depth 0
+	AvgLeafDepth float64 // mean depth of the leaves
+	MinLeafDepth int     // depth of the shallowest leaf
+	MaxLeafDepth int     // depth of the deepest leaf
+}
+
+// Stats returns shape statistics for t, computed in a single traversal.
+// All fields are zero for an empty tree.
+func Stats[K cmp.Ordered, V any](t *Tree[K, V]) TreeStats[K] {
+	var s TreeStats[K]
+	if t.Root == nil {
+		return s
+	}
+	type frame struct {
+		n      *Node[K, V]
+		depth  int
+		blacks int
+	}
+	leaves, total, depths := 0, 0, 0
+	s.MinLeafDepth = Len(t)
+	stack := []frame{{t.Root, 0, 0}}
+	for len(stack) > 0 {
+		f := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		s.Size++
+		depths += f.depth
+		if isRed(f.n) {
+			s.RedNodes++
+		} else {
+			f.blacks++
+		}
+		if f.n.left == nil && f.n.right == nil {
+			leaves++
+			total += f.depth
+			s.MinLeafDepth = min(s.MinLeafDepth, f.depth)
+			s.MaxLeafDepth = max(s.MaxLeafDepth, f.depth)
+			s.BlackHeight = f.blacks
+		}
+		if f.n.right != nil {
+			stack = append(stack, frame{f.n.right, f.depth + 1, f.blacks})
+		}
+		if f.n.left != nil {
+			stack = append(stack, frame{f.n.left, f.depth + 1, f.blacks})
+		}
+	}
+	lo, _ := Min(t)
+	hi, _ := Max(t)
+	s.MinKey, s.MaxKey = lo.key, hi.key
+	s.Height = s.MaxLeafDepth + 1
+	s.AvgDepth = float64(depths) / float64(s.Size)
+	s.AvgLeafDepth = float64(total) / float64(leaves)
+	return s
+}
+
+// Filter returns a new tree containing only the entries for which pred returns true.
+// The source tree is left unchanged.
+func Filter[K cmp.Ordered, V any](t *Tree[K, V], pred func(K, V) bool) *Tree[K, V] {
+	var nodes []*Node[K, V]
+	for n := range InOrder(t) {
+		if pred(n.key, n.value) {
+			nodes = append(nodes, &Node[K, V]{key: n.key, value: n.value})
+		}
+	}
+	out := emptyLike(t)
+	out.Root = buildSorted(out, nodes)
+	return out
+}
+
+// Partition splits the entries of t into two new trees: matched holds the entries
+// for which pred returns true and rest holds the others. The source tree is left unchanged.
+func Partition[K cmp.Ordered, V any](t *Tree[K, V], pred func(key K, value V) bool) (matched, rest *Tree[K, V]) {
+	var yes, no []*Node[K, V]
+	for n := range InOrder(t) {
+		if pred(n.key, n.value) {
+			yes = append(yes, &Node[K, V]{key: n.key, value: n.value})
+		} else {
+			no = append(no, &Node[K, V]{key: n.key, value: n.value})
+		}
+	}
+	matched, rest = emptyLike(t), emptyLike(t)
+	matched.Root = buildSorted(matched, yes)
+	rest.Root = buildSorted(rest, no)
+	return matched, rest
+}
+
+// GroupBy splits the entries of t into new trees keyed by the group that keyFn
+// assigns to each entry. Each group keeps its entries in sorted order, and groups
+// with no entries are absent from the map. The source tree is left unchanged.
+func GroupBy[K cmp.Ordered, V any, G cmp.Ordered](t *Tree[K, V], keyFn func(key K, value V) G) map[G]*Tree[K, V] {
+	groups := make(map[G][]*Node[K, V])
+	for n := range InOrder(t) {
+		g := keyFn(n.key, n.value)
+		groups[g] = append(groups[g], &Node[K, V]{key: n.key, value: n.value})
+	}
+	out := make(map[G]*Tree[K, V], len(groups))
+	for g, nodes := range groups {
+		sub := emptyLike(t)
+		sub.Root = buildSorted(sub, nodes)
+		out[g] = sub
+	}
+	return out
+}
+
+// RangeSum returns the sum of values with keys in [from, to).
+// It runs in O(log n) on trees created by NewSummed and falls back to
+// scanning the range on other trees.
+func RangeSum[K cmp.Ordered, V Number](t *Tree[K, V], from, to K) V {
+	var sum V
+	if from >= to {
+		return sum
+	}
+	if _, ok := t.aug.(summer[K, V]); !ok {
+		for n := range Range(t, from, to) {
+			sum += n.value
+		}
+		return sum
+	}
+	n := splitNode(t, from, to)
+	if n == nil {
+		return sum
+	}
+	sum = n.value
+	for x := n.left; x != nil; {
+		if x.key >= from {
+			sum += x.value + subtreeSum(x.right)
+			x = x.left
+		} else {
+			x = x.right
+		}
+	}
+	for x := n.right; x != nil; {
+		if x.key < to {
+			sum += x.value + subtreeSum(x.left)
+			x = x.right
+		} else {
+			x = x.left
+		}
+	}
+	return sum
+}
+
+// SampleWeighted treats each value as the non-negative weight of its key and
+// returns the key whose share of the cumulative weight, in ascending key order,
+// contains r. Drawing r uniformly from [0, total weight) therefore picks keys
+// in proportion to their weights. It returns false if r is outside that range.
+// It runs in O(log n) on trees created by NewSummed and falls back to
+// scanning the tree on other trees.
+func SampleWeighted[K cmp.Ordered, V Number](t *Tree[K, V], r float64) (K, bool) {
+	var key K
+	if r < 0 {
+		return key, false
+	}
+	if _, ok := t.aug.(summer[K, V]); !ok {
+		for n := range InOrder(t) {
+			if r < float64(n.value) {
+				return n.key, true
+			}
+			r -= float64(n.value)
+		}
+		return key, false
+	}
+	for n := t.Root; n != nil; {
+		left := float64(subtreeSum(n.left))
+		if r < left {
+			n = n.left
+			continue
+		}
+		r -= left
+		if r < float64(n.value) {
+			return n.key, true
+		}
+		r -= float64(n.value)
+		n = n.right
+	}
+	return key, false
+}
+
+// QueryRange returns the aggregate of the entries with keys in [from, to),
+// combined in ascending key order, in O(log n). The tree must have been created
+// by NewAggregated with the same aggregate type A, which usually has to be
+// given explicitly, as in QueryRange[K, V, A](t, from, to).
+func QueryRange[K cmp.Ordered, V any, A any](t *Tree[K, V], from, to K) A {
+	a, ok := t.aug.(*aggregate[K, V, A])
+	if !ok {
+		panic("redblacktrees: QueryRange requires a tree created by NewAggregated with a matching aggregate type")
+	}
+	if from >= to {
+		return a.identity
+	}
+	n := splitNode(t, from, to)
+	if n == nil {
+		return a.identity
+	}
+	// the left boundary is discovered outermost first, so it is accumulated
+	// right to left; the right boundary is accumulated left to right
+	left := a.identity
+	for x := n.left; x != nil; {
+		if x.key >= from {
+			left = a.combine(a.combine(a.measure(x.key, x.value), a.of(x.right)), left)
+			x = x.left
+		} else {
+			x = x.right
+		}
+	}
+	right := a.identity
+	for x := n.right; x != nil; {
+		if x.key < to {
+			right = a.combine(right, a.combine(a.of(x.left), a.measure(x.key, x.value)))
+			x = x.right
+		} else {
+			x = x.left
+		}
+	}
+	return a.combine(a.combine(left, a.measure(n.key, n.value)), right)
+}
+
+// Overlapping returns an iterator over the intervals that overlap [lo, hi), in
+// ascending order of their starts. Subtrees whose intervals all end at or
+// before lo are skipped, so it visits O(k log n) nodes for k results.
+// The tree must have been created by NewIntervals, and the iterator is empty
+// if lo >= hi.
+func Overlapping[K cmp.Ordered, V any](t *Tree[K, V], lo, hi K) iter.Seq[Node[K, V]] {
+	a, ok := t.aug.(*aggregate[K, V, maxEnd[K]])
+	if !ok {
+		panic("redblacktrees: Overlapping requires a tree created by NewIntervals")
+	}
+	return func(yield func(Node[K, V]) bool) {
+		if lo >= hi {
+			return
+		}
+		var stack []*Node[K, V]
+		curr := t.Root
+		for curr != nil || len(stack) > 0 {
+			for curr != nil && a.of(curr).end > lo {
+				stack = append(stack, curr)
+				curr = curr.left
+			}
+			if len(stack) == 0 {
+				return
+			}
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if n.key >= hi {
+				return
+			}
+			if a.measure(n.key, n.value).end > lo {
+				if !yield(*n) {
+					return
+				}
+			}
+			curr = n.right
+		}
+	}
+}
+
+// maxEnd is the aggregate of trees created by NewIntervals: the largest
+// interval end in a subtree, if the subtree is not empty.
+type maxEnd[K cmp.Ordered] struct {
+	end K
+	ok  bool
+}
+
+func (m maxEnd[K]) max(o maxEnd[K]) maxEnd[K] {
+	if !m.ok || (o.ok && o.end > m.end) {
+		return o
+	}
+	return m
+}
+
+// Moments holds the count, sum, and sum of squares of a set of values, as
+// maintained by trees created by NewMoments.
+type Moments struct {
+	Count int
+	Sum   float64
+	SumSq float64
+}
+
+func (m Moments) add(o Moments) Moments {
+	return Moments{Count: m.Count + o.Count, Sum: m.Sum + o.Sum, SumSq: m.SumSq + o.SumSq}
+}
+
+// RangeMean returns the mean of the values with keys in [from, to) in O(log n),
+// or false if the range is empty. The tree must have been created by NewMoments.
+func RangeMean[K cmp.Ordered, V Number](t *Tree[K, V], from, to K) (float64, bool) {
+	m := QueryRange[K, V, Moments](t, from, to)
+	if m.Count == 0 {
+		return 0, false
+	}
+	return m.Sum / float64(m.Count), true
+}
+
+// RangeVariance returns the population variance of the values with keys in
+// [from, to) in O(log n), or false if the range is empty. The tree must have
+// been created by NewMoments.
+func RangeVariance[K cmp.Ordered, V Number](t *Tree[K, V], from, to K) (float64, bool) {
+	m := QueryRange[K, V, Moments](t, from, to)
+	if m.Count == 0 {
+		return 0, false
+	}
+	mean := m.Sum / float64(m.Count)
+	// rounding can push the difference slightly below zero
+	return max(m.SumSq/float64(m.Count)-mean*mean, 0), true
+}
+
+// IsSubset reports whether every key of a is also present in b.
+// Only keys are compared; values are ignored. It runs in O(n+m) by walking both trees in order.
+func IsSubset[K cmp.Ordered, V any](a, b *Tree[K, V]) bool {
+	y, _ := Min(b)
+	for x, _ := Min(a); x != nil; x, _ = Successor(x) {
+		for y != nil && y.key < x.key {
+			y, _ = Successor(y)
+		}
+		if y == nil || y.key != x.key {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSuperset reports whether every key of b is also present in a.
+// Only keys are compared; values are ignored.
+func IsSuperset[K cmp.Ordered, V any](a, b *Tree[K, V]) bool {
+	return IsSubset(b, a)
+}
+
+// SymmetricDifference returns a new tree holding the entries whose keys are present
+// in exactly one of a and b. Both trees are walked once in order, so it runs in O(n+m).
+func SymmetricDifference[K cmp.Ordered, V any](a, b *Tree[K, V]) *Tree[K, V] {
+	var nodes []*Node[K, V]
+	x, _ := Min(a)
+	y, _ := Min(b)
+	for x != nil || y != nil {
+		switch {
+		case y == nil || (x != nil && x.key < y.key):
+			nodes = append(nodes, &Node[K, V]{key: x.key, value: x.value})
+			x, _ = Successor(x)
+		case x == nil || y.key < x.key:
+			nodes = append(nodes, &Node[K, V]{key: y.key, value: y.value})
+			y, _ = Successor(y)
+		default:
+			x, _ = Successor(x)
+			y, _ = Successor(y)
+		}
+	}
+	out := emptyLike(a)
+	out.Root = buildSorted(out, nodes)
+	return out
+}
+
+// Merge moves every entry of src into dst in O(m log(n+m)) and leaves src
+// empty. On key collisions the value from src replaces the one in dst, and on a
+// tree created by NewMulti the entries of src follow any equal keys already in
+// dst. The nodes of src are relinked into dst rather than copied, so the only
+// allocation is a temporary slice of m pointers, plus subtree data if dst is
+// augmented. As with Clear, src.OnChange is not called for the entries it
+// loses. Merging a tree into itself does nothing.
+func Merge[K cmp.Ordered, V any](dst, src *Tree[K, V]) {
+	if dst == src {
+		return
+	}
+	nodes := make([]*Node[K, V], 0, Len(src))
+	for n, ok := Min(src); ok; n, ok = Successor(n) {
+		nodes = append(nodes, n)
+	}
+	src.Root = nil
+	for _, z := range nodes {
+		if !dst.multi && Update(dst, z.key, z.value) {
+			continue
+		}
+		// the subtree data of src may be of another type than dst's
+		z.left, z.right, z.color, z.size, z.agg = nil, nil, red, 1, nil
+		link(dst, z)
+	}
+}
+
+// MergeIter returns an iterator over the entries of all the given trees in
+// ascending key order. Each distinct key is yielded once: when several trees
+// hold the same key, the entry from the earliest tree in the argument list
+// wins, and within a tree created by NewMulti the first of the equal keys wins.
+// The trees must not be modified during the iteration.
+func MergeIter[K cmp.Ordered, V any](trees ...*Tree[K, V]) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		h := make(mergeHeap[K, V], 0, len(trees))
+		for i, t := range trees {
+			if n, ok := Min(t); ok {
+				h = append(h, mergeCursor[K, V]{n, i})
+			}
+		}
+		heap.Init(&h)
+		var last K
+		started := false
+		for len(h) > 0 {
+			n := h[0].n
+			if !started || n.key != last {
+				if !yield(n.key, n.value) {
+					return
+				}
+				last, started = n.key, true
+			}
+			if next, ok := Successor(n); ok {
+				h[0].n = next
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+	}
+}
+
+// MergeIterFunc is like MergeIter for two trees, but when a key is in both a
+// and b it yields resolve(av, bv) instead of the value from a. The union is
+// produced by a two-cursor in-order walk in O(n+m) without building a tree.
+// Keys repeated within a tree created by NewMulti are yielded once, using the
+// first of the equal keys.
+func MergeIterFunc[K cmp.Ordered, V any](a, b *Tree[K, V], resolve func(av, bv V) V) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		x, _ := Min(a)
+		y, _ := Min(b)
+		for x != nil || y != nil {
+			var key K
+			var value V
+			switch {
+			case y == nil || (x != nil && x.key < y.key):
+				key, value = x.key, x.value
+			case x == nil || y.key < x.key:
+				key, value = y.key, y.value
+			default:
+				key, value = x.key, resolve(x.value, y.value)
+			}
+			if !yield(key, value) {
+				return
+			}
+			for x != nil && x.key == key {
+				x, _ = Successor(x)
+			}
+			for y != nil && y.key == key {
+				y, _ = Successor(y)
+			}
+		}
+	}
+}
+
+// mergeCursor is the current node of one tree in a MergeIter, along with the
+// tree's position in the argument list, which breaks ties between equal keys.
+type mergeCursor[K cmp.Ordered, V any] struct {
+	n   *Node[K, V]
+	idx int
+}
+
+// mergeHeap is a min-heap of cursors ordered by key and then by tree position.
+type mergeHeap[K cmp.Ordered, V any] []mergeCursor[K, V]
+
+func (h mergeHeap[K, V]) Len() int { return len(h) }
+
+func (h mergeHeap[K, V]) Less(i, j int) bool {
+	if h[i].n.key != h[j].n.key {
+		return h[i].n.key < h[j].n.key
+	}
+	return h[i].idx < h[j].idx
+}
+
+func (h mergeHeap[K, V]) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap[K, V]) Push(x any) { *h = append(*h, x.(mergeCursor[K, V])) }
+
+func (h *mergeHeap[K, V]) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// Equal reports whether a and b hold the same keys with equal values, in the
+// same order. The shapes of the trees need not match.
+func Equal[K cmp.Ordered, V comparable](a, b *Tree[K, V]) bool {
+	return EqualFunc(a, b, func(x, y V) bool { return x == y })
+}
+
+// EqualFunc is like Equal but compares values with eq, for value types that are
+// not comparable or that need a tolerance. Keys are still compared with ==.
+func EqualFunc[K cmp.Ordered, V any](a, b *Tree[K, V], eq func(x, y V) bool) bool {
+	if Len(a) != Len(b) {
+		return false
+	}
+	x, _ := Min(a)
+	y, _ := Min(b)
+	for x != nil {
+		if x.key != y.key || !eq(x.value, y.value) {
+			return false
+		}
+		x, _ = Successor(x)
+		y, _ = Successor(y)
+	}
+	return true
 }
 
-// Floor returns the node with the greatest key less than or equal to the given key.
-func Floor[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
-	curr := t.Root
-	var result *Node[K, V]
-	for curr != nil {
-		if key == curr.key {
-			return curr, true
-		} else if key < curr.key {
-			curr = curr.left
-		} else {
-			result = curr
-			curr = curr.right
+// EqualKeys reports whether a and b hold the same keys, ignoring their values.
+func EqualKeys[K cmp.Ordered, V any](a, b *Tree[K, V]) bool {
+	return EqualFunc(a, b, func(V, V) bool { return true })
+}
+
+// Compare lexicographically compares the in-order (key, value) sequences of a
+// and b, like comparing two sorted slices element by element. It returns -1, 0,
+// or +1, and a tree that is a prefix of the other compares as less. Both keys
+// and values must be ordered; they are compared with cmp.Compare.
+func Compare[K, V cmp.Ordered](a, b *Tree[K, V]) int {
+	x, _ := Min(a)
+	y, _ := Min(b)
+	for x != nil && y != nil {
+		if c := cmp.Compare(x.key, y.key); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(x.value, y.value); c != 0 {
+			return c
 		}
+		x, _ = Successor(x)
+		y, _ = Successor(y)
 	}
-	return result, result != nil
+	switch {
+	case x != nil:
+		return +1
+	case y != nil:
+		return -1
+	}
+	return 0
 }
 
-// Higher returns the node with the smallest key greater than the given key.
-func Higher[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
-	curr := t.Root
-	var result *Node[K, V]
-	for curr != nil {
-		if key < curr.key {
-			result = curr
-			curr = curr.left
-		} else {
-			curr = curr.right
+// Diff compares two versions of a tree in a single O(n+m) in-order walk.
+// added holds the keys only in next, removed the keys only in prev, and changed
+// the keys present in both whose values differ. Each slice is in ascending order.
+// Values are compared with ==; use DiffFunc for values that are not comparable.
+func Diff[K cmp.Ordered, V comparable](prev, next *Tree[K, V]) (added, removed, changed []K) {
+	return DiffFunc(prev, next, func(x, y V) bool { return x == y })
+}
+
+// DiffFunc is like Diff but reports a key as changed when eq returns false for
+// its old and new values.
+func DiffFunc[K cmp.Ordered, V any](prev, next *Tree[K, V], eq func(x, y V) bool) (added, removed, changed []K) {
+	x, _ := Min(prev)
+	y, _ := Min(next)
+	for x != nil || y != nil {
+		switch {
+		case y == nil || (x != nil && x.key < y.key):
+			removed = append(removed, x.key)
+			x, _ = Successor(x)
+		case x == nil || y.key < x.key:
+			added = append(added, y.key)
+			y, _ = Successor(y)
+		default:
+			if !eq(x.value, y.value) {
+				changed = append(changed, x.key)
+			}
+			x, _ = Successor(x)
+			y, _ = Successor(y)
 		}
 	}
-	return result, result != nil
+	return added, removed, changed
 }
 
-// Lower returns the node with the greatest key less than the given key.
-func Lower[K cmp.Ordered, V any](t *Tree[K, V], key K) (*Node[K, V], bool) {
-	curr := t.Root
-	var result *Node[K, V]
-	for curr != nil {
-		if key <= curr.key {
-			curr = curr.left
-		} else {
-			result = curr
-			curr = curr.right
+// Patch applies a delta to t: the keys in removed are deleted, then the entries
+// of added and changed are stored as by Insert. Together with Diff it lets a
+// replica be brought up to date by transmitting only the changes.
+func Patch[K cmp.Ordered, V any](t *Tree[K, V], added map[K]V, removed []K, changed map[K]V) {
+	for _, key := range removed {
+		Delete(t, key)
+	}
+	for key, value := range added {
+		Insert(t, key, value)
+	}
+	for key, value := range changed {
+		Insert(t, key, value)
+	}
+}
+
+// binaryVersion is the format version written as the first byte by
+// MarshalBinary.
+const binaryVersion = 1
+
+var errTruncated = errors.New("redblacktrees: binary data is truncated")
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding is a version
+// byte, the number of entries as a uvarint, and then each key and value in
+// ascending key order. Integers are written as varints, floats as 8 bytes,
+// strings with a uvarint length prefix, and a key or value whose type
+// implements encoding.BinaryMarshaler as its length-prefixed MarshalBinary
+// output. A pointer is preceded by a byte recording whether it is nil. Any
+// other value type is an error. Only the entries are encoded, not whether t
+// was created by NewMulti.
+func (t *Tree[K, V]) MarshalBinary() ([]byte, error) {
+	buf := []byte{binaryVersion}
+	buf = binary.AppendUvarint(buf, uint64(Len(t)))
+	for n, ok := Min(t); ok; n, ok = Successor(n) {
+		var err error
+		if buf, err = appendBinary(buf, n.key); err != nil {
+			return nil, err
+		}
+		if buf, err = appendBinary(buf, n.value); err != nil {
+			return nil, err
 		}
 	}
-	return result, result != nil
+	return buf, nil
 }
 
-// Predecessor returns the in-order predecessor node of n, if any.
-func Predecessor[K cmp.Ordered, V any](n *Node[K, V]) (*Node[K, V], bool) {
-	if n.left != nil {
-		x := n.left
-		for x.right != nil {
-			x = x.right
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, decoding data written
+// by MarshalBinary. It replaces the contents of t and, because the entries are
+// already sorted, builds the tree in O(n) without rebalancing. Values decoded
+// through encoding.BinaryMarshaler must also implement
+// encoding.BinaryUnmarshaler. Keys must be ascending, and may repeat only if t
+// was created by NewMulti. On error t is left unchanged. Like Rebuild, it does
+// not call OnChange.
+func (t *Tree[K, V]) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != binaryVersion {
+		return errors.New("redblacktrees: unsupported binary format version")
+	}
+	count, k := binary.Uvarint(data[1:])
+	if k <= 0 {
+		return errors.New("redblacktrees: invalid entry count")
+	}
+	data = data[1+k:]
+	if count > uint64(len(data)) {
+		return errTruncated
+	}
+	nodes := make([]*Node[K, V], 0, count)
+	for range count {
+		n := &Node[K, V]{}
+		var err error
+		if data, err = readBinary(data, &n.key); err != nil {
+			return err
 		}
-		return x, true
+		if data, err = readBinary(data, &n.value); err != nil {
+			return err
+		}
+		if n.key != n.key {
+			return fmt.Errorf("redblacktrees: key %v is NaN", n.key)
+		}
+		if last := len(nodes) - 1; last >= 0 {
+			prev := nodes[last].key
+			if n.key < prev || (n.key == prev && !t.multi) {
+				return fmt.Errorf("redblacktrees: key %v is out of order", n.key)
+			}
+		}
+		nodes = append(nodes, n)
 	}
-	p := n.parent
-	for p != nil && n == p.left {
-		n = p
-		p = p.parent
+	if len(data) != 0 {
+		return errors.New("redblacktrees: trailing data after last entry")
 	}
-	return p, p != nil
+	t.Root = buildSorted(t, nodes)
+	return nil
 }
 
-// Successor returns the in-order successor node of n, if any.
-func Successor[K cmp.Ordered, V any](n *Node[K, V]) (*Node[K, V], bool) {
-	if n.right != nil {
-		x := n.right
-		for x.left != nil {
-			x = x.left
+func appendBinary[T any](buf []byte, v T) ([]byte, error) {
+	rv := reflect.ValueOf(&v).Elem()
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return append(buf, 0), nil
 		}
-		return x, true
+		buf = append(buf, 1)
 	}
-	p := n.parent
-	for p != nil && n == p.right {
-		n = p
-		p = p.parent
+	m, ok := any(v).(encoding.BinaryMarshaler)
+	if !ok {
+		m, ok = any(&v).(encoding.BinaryMarshaler)
 	}
-	return p, p != nil
+	if ok {
+		// a nil pointer held in an interface would panic in MarshalBinary
+		if mv := reflect.ValueOf(m); mv.Kind() == reflect.Pointer && mv.IsNil() {
+			return nil, fmt.Errorf("redblacktrees: cannot encode nil %T", m)
+		}
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		return append(buf, b...), nil
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(buf, rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.AppendUvarint(buf, rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(rv.Float())), nil
+	case reflect.String:
+		buf = binary.AppendUvarint(buf, uint64(rv.Len()))
+		return append(buf, rv.String()...), nil
+	case reflect.Bool:
+		if rv.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	}
+	return nil, fmt.Errorf("redblacktrees: cannot encode value of type %T", v)
 }
 
-// InOrder returns an iterator for in-order traversal of the tree.
-func InOrder[K cmp.Ordered, V any](t *Tree[K, V]) iter.Seq[Node[K, V]] {
-	return func(yield func(Node[K, V]) bool) {
-		var stack []*Node[K, V]
-		curr := t.Root
-		for curr != nil || len(stack) > 0 {
-			for curr != nil {
-				stack = append(stack, curr)
-				curr = curr.left
-			}
-			n := stack[len(stack)-1]
-			stack = stack[:len(stack)-1]
-			if !yield(*n) {
-				return
-			}
-			curr = n.right
+func readBinary[T any](data []byte, v *T) ([]byte, error) {
+	rv := reflect.ValueOf(v).Elem()
+	target := any(v)
+	if rv.Kind() == reflect.Pointer {
+		if len(data) < 1 {
+			return nil, errTruncated
+		}
+		if data[0] == 0 {
+			rv.SetZero()
+			return data[1:], nil
+		}
+		data = data[1:]
+		rv.Set(reflect.New(rv.Type().Elem()))
+		target = rv.Interface()
+	}
+	if u, ok := target.(encoding.BinaryUnmarshaler); ok {
+		l, k := binary.Uvarint(data)
+		if k <= 0 || l > uint64(len(data)-k) {
+			return nil, errTruncated
+		}
+		data = data[k:]
+		return data[l:], u.UnmarshalBinary(data[:l])
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, k := binary.Varint(data)
+		if k <= 0 {
+			return nil, errTruncated
+		}
+		if rv.OverflowInt(x) {
+			return nil, fmt.Errorf("redblacktrees: %d overflows %T", x, *v)
+		}
+		rv.SetInt(x)
+		return data[k:], nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, k := binary.Uvarint(data)
+		if k <= 0 {
+			return nil, errTruncated
 		}
+		if rv.OverflowUint(x) {
+			return nil, fmt.Errorf("redblacktrees: %d overflows %T", x, *v)
+		}
+		rv.SetUint(x)
+		return data[k:], nil
+	case reflect.Float32, reflect.Float64:
+		if len(data) < 8 {
+			return nil, errTruncated
+		}
+		rv.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(data)))
+		return data[8:], nil
+	case reflect.String:
+		l, k := binary.Uvarint(data)
+		if k <= 0 || l > uint64(len(data)-k) {
+			return nil, errTruncated
+		}
+		data = data[k:]
+		rv.SetString(string(data[:l]))
+		return data[l:], nil
+	case reflect.Bool:
+		if len(data) < 1 {
+			return nil, errTruncated
+		}
+		rv.SetBool(data[0] != 0)
+		return data[1:], nil
 	}
+	return nil, fmt.Errorf("redblacktrees: cannot decode value of type %T", *v)
 }
 
-// Range returns an iterator over nodes with keys in [from, to).
-func Range[K cmp.Ordered, V any](t *Tree[K, V], from, to K) iter.Seq[Node[K, V]] {
-	return func(yield func(Node[K, V]) bool) {
-		var stack []*Node[K, V]
-		curr := t.Root
-		for curr != nil || len(stack) > 0 {
-			for curr != nil {
-				stack = append(stack, curr)
-				curr = curr.left
-			}
-			n := stack[len(stack)-1]
-			stack = stack[:len(stack)-1]
-			if n.key >= from && n.key < to {
-				if !yield(*n) {
-					return
-				}
-			}
-			if n.key >= to {
-				curr = nil
-			} else {
-				curr = n.right
-			}
-		}
+// IsValid reports whether t is a valid red-black tree: the root is black, no red
+// node has a red child, every path has the same number of black nodes, keys are in
+// search-tree order, and every node's parent link and subtree size are consistent.
+func IsValid[K cmp.Ordered, V any](t *Tree[K, V]) bool {
+	return CheckInvariants(t) == nil
+}
+
+// CheckInvariants performs the same checks as IsValid and returns an error
+// describing the first violation found, or nil if t is a valid red-black tree.
+func CheckInvariants[K cmp.Ordered, V any](t *Tree[K, V]) error {
+	if isRed(t.Root) {
+		return errors.New("redblacktrees: root is red")
+	}
+	if t.Root != nil && t.Root.parent != nil {
+		return errors.New("redblacktrees: root has a parent")
 	}
+	_, err := validate(t.Root, nil, nil)
+	return err
 }
 
-// Rank returns the number of nodes with keys less than the given key.
-func Rank[K cmp.Ordered, V any](t *Tree[K, V], key K) int {
-	rank := 0
-	curr := t.Root
-	for curr != nil {
-		if key < curr.key {
-			curr = curr.left
+// VerifySizes reports whether every node's stored subtree size matches the
+// number of nodes actually below it. It is a narrower, cheaper check than
+// CheckInvariants for the counts that Rank, Kth, and Len rely on.
+func VerifySizes[K cmp.Ordered, V any](t *Tree[K, V]) bool {
+	_, ok := countNodes(t.Root)
+	return ok
+}
+
+// countNodes returns the number of nodes in the subtree rooted at n and whether
+// every stored size within it is correct.
+func countNodes[K cmp.Ordered, V any](n *Node[K, V]) (int, bool) {
+	if n == nil {
+		return 0, true
+	}
+	l, lok := countNodes(n.left)
+	r, rok := countNodes(n.right)
+	count := 1 + l + r
+	return count, lok && rok && n.size == count
+}
+
+// validate checks the subtree rooted at n, whose keys must lie within [lo, hi]
+// where non-nil, and returns its black height.
+func validate[K cmp.Ordered, V any](n *Node[K, V], lo, hi *K) (int, error) {
+	if n == nil {
+		return 1, nil
+	}
+	if (lo != nil && n.key < *lo) || (hi != nil && n.key > *hi) {
+		return 0, fmt.Errorf("redblacktrees: key %v is out of search-tree order", n.key)
+	}
+	if isRed(n) && (isRed(n.left) || isRed(n.right)) {
+		return 0, fmt.Errorf("redblacktrees: red node %v has a red child", n.key)
+	}
+	if (n.left != nil && n.left.parent != n) || (n.right != nil && n.right.parent != n) {
+		return 0, fmt.Errorf("redblacktrees: a child of node %v has a wrong parent link", n.key)
+	}
+	if want := 1 + sizeOf(n.left) + sizeOf(n.right); n.size != want {
+		return 0, fmt.Errorf("redblacktrees: node %v has size %d, want %d", n.key, n.size, want)
+	}
+	lh, err := validate(n.left, lo, &n.key)
+	if err != nil {
+		return 0, err
+	}
+	rh, err := validate(n.right, &n.key, hi)
+	if err != nil {
+		return 0, err
+	}
+	if lh != rh {
+		return 0, fmt.Errorf("redblacktrees: node %v has black heights %d and %d", n.key, lh, rh)
+	}
+	if !isRed(n) {
+		lh++
+	}
+	return lh, nil
+}
+
+// splitNode returns the highest node with a key in [from, to), or nil if there is none.
+// Every other node in the range lies in its left or right subtree.
+func splitNode[K cmp.Ordered, V any](t *Tree[K, V], from, to K) *Node[K, V] {
+	n := t.Root
+	for n != nil && (n.key < from || n.key >= to) {
+		if n.key < from {
+			n = n.right
 		} else {
-			leftSize := 0
-			if curr.left != nil {
-				leftSize = curr.left.size
-			}
-			if key == curr.key {
-				rank += leftSize
-				break
-			}
-			rank += leftSize + 1
-			curr = curr.right
+			n = n.left
 		}
 	}
-	return rank
+	return n
 }
 
-// Kth returns the node with the given 0-based rank (k).
-func Kth[K cmp.Ordered, V any](t *Tree[K, V], k int) (*Node[K, V], bool) {
+// rankUpper returns the number of nodes with keys less than or equal to key.
+func rankUpper[K cmp.Ordered, V any](t *Tree[K, V], key K) int {
+	rank := 0
 	curr := t.Root
 	for curr != nil {
-		leftSize := 0
-		if curr.left != nil {
-			leftSize = curr.left.size
-		}
-		if k < leftSize {
+		if key < curr.key {
 			curr = curr.left
-		} else if k > leftSize {
-			k -= leftSize + 1
-			curr = curr.right
 		} else {
-			return curr, true
+			rank += sizeOf(curr.left) + 1
+			curr = curr.right
 		}
 	}
-	return nil, false
+	return rank
 }
 
-// Len returns the number of nodes in the tree.
-func Len[K cmp.Ordered, V any](t *Tree[K, V]) int {
-	if t.Root == nil {
+func sizeOf[K cmp.Ordered, V any](n *Node[K, V]) int {
+	if n == nil {
 		return 0
 	}
-	return t.Root.size
+	return n.size
 }
 
-func updateSize[K cmp.Ordered, V any](n *Node[K, V]) {
+func updateSize[K cmp.Ordered, V any](t *Tree[K, V], n *Node[K, V]) {
 	if n == nil {
 		return
 	}
@@ -382,15 +2602,152 @@ func updateSize[K cmp.Ordered, V any](n *Node[K, V]) {
 	if n.right != nil {
 		n.size += n.right.size
 	}
+	if t.aug != nil {
+		t.aug.update(n)
+	}
 }
 
-func fixSizeUpward[K cmp.Ordered, V any](n *Node[K, V]) {
+func fixSizeUpward[K cmp.Ordered, V any](t *Tree[K, V], n *Node[K, V]) {
 	for n != nil {
-		updateSize(n)
+		updateSize(t, n)
 		n = n.parent
 	}
 }
 
+// augmenter maintains per-node data derived from a node and its children.
+// update is called bottom-up whenever a node's subtree changes.
+//
+// The data lives behind Node.agg as a *V or *A, so plain trees pay only for
+// an empty interface. Storing a pointer there does not allocate, and reading
+// it back is a checked assertion: a root moved by hand between trees with
+// different augmenters panics rather than misreading the data.
+type augmenter[K cmp.Ordered, V any] interface {
+	update(n *Node[K, V])
+}
+
+// summer stores the sum of values in each subtree as a *V in Node.agg.
+type summer[K cmp.Ordered, V Number] struct{}
+
+func (summer[K, V]) update(n *Node[K, V]) {
+	p, ok := n.agg.(*V)
+	if !ok {
+		p = new(V)
+		n.agg = p
+	}
+	*p = n.value + subtreeSum(n.left) + subtreeSum(n.right)
+}
+
+func subtreeSum[K cmp.Ordered, V Number](n *Node[K, V]) V {
+	if n == nil {
+		var zero V
+		return zero
+	}
+	return *n.agg.(*V)
+}
+
+// aggregate stores the combined measure of each subtree as a *A in Node.agg.
+type aggregate[K cmp.Ordered, V any, A any] struct {
+	identity A
+	measure  func(K, V) A
+	combine  func(A, A) A
+}
+
+func (a *aggregate[K, V, A]) update(n *Node[K, V]) {
+	p, ok := n.agg.(*A)
+	if !ok {
+		p = new(A)
+		n.agg = p
+	}
+	*p = a.combine(a.combine(a.of(n.left), a.measure(n.key, n.value)), a.of(n.right))
+}
+
+func (a *aggregate[K, V, A]) of(n *Node[K, V]) A {
+	if n == nil {
+		return a.identity
+	}
+	return *n.agg.(*A)
+}
+
+// emptyLike returns a new empty tree configured like t.
+func emptyLike[K cmp.Ordered, V any](t *Tree[K, V]) *Tree[K, V] {
+	return &Tree[K, V]{aug: t.aug, multi: t.multi}
+}
+
+func cloneNode[K cmp.Ordered, V any](t *Tree[K, V], n, parent *Node[K, V]) *Node[K, V] {
+	if n == nil {
+		return nil
+	}
+	c := &Node[K, V]{key: n.key, value: n.value, color: n.color, parent: parent}
+	c.left = cloneNode(t, n.left, c)
+	c.right = cloneNode(t, n.right, c)
+	updateSize(t, c)
+	return c
+}
+
+// entryOf unpacks the result of a node lookup into a key and value.
+func entryOf[K cmp.Ordered, V any](n *Node[K, V], ok bool) (K, V, bool) {
+	if !ok {
+		var key K
+		var value V
+		return key, value, false
+	}
+	return n.key, n.value, true
+}
+
+// dismantle calls release on every node of the subtree rooted at n, using O(1)
+// extra space. Each node's children are already detached when it is released.
+func dismantle[K cmp.Ordered, V any](n *Node[K, V], release func(*Node[K, V])) {
+	for n != nil {
+		if l := n.left; l != nil {
+			// rotate the left child up so that n can be released without a stack
+			n.left = l.right
+			l.right = n
+			n = l
+			continue
+		}
+		next := n.right
+		release(n)
+		n = next
+	}
+}
+
+// newNode returns a red leaf holding key and value, reusing a node freed by Reset if possible.
+func newNode[K cmp.Ordered, V any](t *Tree[K, V], key K, value V) *Node[K, V] {
+	if n := t.free; n != nil {
+		t.free = n.right
+		n.right = nil
+		n.key, n.value, n.color, n.size = key, value, red, 1
+		return n
+	}
+	return &Node[K, V]{key: key, value: value, color: red, size: 1}
+}
+
+// attach links the new node z below parent y and rebalances the tree.
+// Sizes on the path from the root to y must already account for z.
+func attach[K cmp.Ordered, V any](t *Tree[K, V], z, y *Node[K, V]) {
+	z.parent = y
+	if y == nil {
+		t.Root = z
+	} else if z.key < y.key {
+		y.left = z
+	} else {
+		y.right = z
+	}
+	if t.aug != nil {
+		fixSizeUpward(t, z)
+	}
+	insertFixup(t, z)
+	var zero V
+	notify(t, Inserted, z.key, zero, z.value)
+}
+
+// notify reports a completed change to t.OnChange, if set.
+func notify[K cmp.Ordered, V any](t *Tree[K, V], kind ChangeKind, key K, old, new V) {
+	if t.OnChange != nil {
+		t.OnChange(ChangeEvent[K, V]{Kind: kind, Key: key, Old: old, New: new})
+	}
+}
+
 func insertFixup[K cmp.Ordered, V any](t *Tree[K, V], z *Node[K, V]) {
 	for isRed(z.parent) {
 		if z.parent == z.parent.parent.left {
@@ -430,6 +2787,10 @@ func insertFixup[K cmp.Ordered, V any](t *Tree[K, V], z *Node[K, V]) {
 	setColor(t.Root, black)
 }
 
+// deleteFixup restores the red-black properties after removing a black node.
+// x carries the extra black and parent must be its actual parent, since x may be nil.
+// While x is doubly black its sibling w always exists, as the sibling's subtree
+// has a black height of at least one.
 func deleteFixup[K cmp.Ordered, V any](t *Tree[K, V], x, parent *Node[K, V]) {
 	for x != t.Root && !isRed(x) && parent != nil {
 		if x == parent.left {
@@ -446,9 +2807,7 @@ func deleteFixup[K cmp.Ordered, V any](t *Tree[K, V], x, parent *Node[K, V]) {
 				parent = x.parent
 			} else {
 				if !isRed(w.right) {
-					if w.left != nil {
-						setColor(w.left, black)
-					}
+					setColor(w.left, black)
 					setColor(w, red)
 					rotateRight(t, w)
 					w = parent.right
@@ -474,18 +2833,14 @@ func deleteFixup[K cmp.Ordered, V any](t *Tree[K, V], x, parent *Node[K, V]) {
 				parent = x.parent
 			} else {
 				if !isRed(w.left) {
-					if w.right != nil {
-						setColor(w.right, black)
-					}
+					setColor(w.right, black)
 					setColor(w, red)
 					rotateLeft(t, w)
 					w = parent.left
 				}
 				setColor(w, parent.color)
 				setColor(parent, black)
-				if w != nil && w.left != nil {
-					setColor(w.left, black)
-				}
+				setColor(w.left, black)
 				rotateRight(t, parent)
 				x = t.Root
 				break
@@ -536,8 +2891,8 @@ func rotateLeft[K cmp.Ordered, V any](t *Tree[K, V], x *Node[K, V]) {
 	}
 	y.left = x
 	x.parent = y
-	updateSize(x)
-	updateSize(y)
+	updateSize(t, x)
+	updateSize(t, y)
 }
 
 func rotateRight[K cmp.Ordered, V any](t *Tree[K, V], y *Node[K, V]) {
@@ -556,8 +2911,8 @@ func rotateRight[K cmp.Ordered, V any](t *Tree[K, V], y *Node[K, V]) {
 	}
 	x.right = y
 	y.parent = x
-	updateSize(y)
-	updateSize(x)
+	updateSize(t, y)
+	updateSize(t, x)
 }
 
 func minimum[K cmp.Ordered, V any](n *Node[K, V]) *Node[K, V] {
@@ -566,3 +2921,30 @@ func minimum[K cmp.Ordered, V any](n *Node[K, V]) *Node[K, V] {
 	}
 	return n
 }
+
+// buildSorted links nodes, which must be in ascending key order, into a
+// balanced red-black tree in O(n) and returns its root. Every node is black
+// except those on the deepest level, which are red whenever the tree has more
+// than one level, whether or not that level is full.
+func buildSorted[K cmp.Ordered, V any](t *Tree[K, V], nodes []*Node[K, V]) *Node[K, V] {
+	root := buildBalanced(t, nodes, nil, 0, bits.Len(uint(len(nodes)))-1)
+	setColor(root, black)
+	return root
+}
+
+func buildBalanced[K cmp.Ordered, V any](t *Tree[K, V], nodes []*Node[K, V], parent *Node[K, V], depth, redDepth int) *Node[K, V] {
+	if len(nodes) == 0 {
+		return nil
+	}
+	mid := len(nodes) / 2
+	n := nodes[mid]
+	n.parent = parent
+	n.color = black
+	if depth == redDepth {
+		n.color = red
+	}
+	n.left = buildBalanced(t, nodes[:mid], n, depth+1, redDepth)
+	n.right = buildBalanced(t, nodes[mid+1:], n, depth+1, redDepth)
+	updateSize(t, n)
+	return n
+}
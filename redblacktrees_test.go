@@ -2,8 +2,14 @@ package redblacktrees_test
 
 import (
 	"fmt"
+	"math"
+	"math/bits"
 	"math/rand"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	rbts "github.com/byExist/redblacktrees"
 	"github.com/stretchr/testify/assert"
@@ -55,6 +61,31 @@ func TestDelete(t *testing.T) {
 	assert.False(t, found, "Key 10 should have been deleted")
 }
 
+func TestDeleteIf(t *testing.T) {
+	tree := rbts.New[string, int]()
+	rbts.Insert(tree, "fresh", 100)
+	rbts.Insert(tree, "stale", 5)
+	expired := func(deadline int) bool { return deadline < 50 }
+
+	assert.False(t, rbts.DeleteIf(tree, "missing", expired), "absent key")
+	assert.False(t, rbts.DeleteIf(tree, "fresh", expired), "pred fails")
+	_, found := rbts.Search(tree, "fresh")
+	assert.True(t, found)
+
+	assert.True(t, rbts.DeleteIf(tree, "stale", expired))
+	_, found = rbts.Search(tree, "stale")
+	assert.False(t, found)
+	assert.Equal(t, 1, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+
+	multi := rbts.NewMulti[int, string]()
+	rbts.Insert(multi, 1, "keep")
+	rbts.Insert(multi, 1, "drop")
+	isDrop := func(v string) bool { return v == "drop" }
+	assert.False(t, rbts.DeleteIf(multi, 1, isDrop), "only the earliest occurrence is checked")
+	assert.Equal(t, 2, rbts.Len(multi))
+}
+
 func TestSearch(t *testing.T) {
 	tree := rbts.New[int, string]()
 	rbts.Insert(tree, 10, "ten")
@@ -90,6 +121,24 @@ func TestMax(t *testing.T) {
 	assert.Equal(t, 30, m.Key())
 }
 
+func TestFirstLast(t *testing.T) {
+	tree := rbts.New[int, string]()
+	_, ok := rbts.First(tree)
+	assert.False(t, ok)
+	_, ok = rbts.Last(tree)
+	assert.False(t, ok)
+
+	for _, v := range []int{20, 10, 30} {
+		rbts.Insert(tree, v, "")
+	}
+	first, ok := rbts.First(tree)
+	require.True(t, ok)
+	assert.Equal(t, 10, first.Key())
+	last, ok := rbts.Last(tree)
+	require.True(t, ok)
+	assert.Equal(t, 30, last.Key())
+}
+
 func TestCeiling(t *testing.T) {
 	tree := rbts.New[int, string]()
 	for _, v := range []int{10, 20, 30} {
@@ -126,6 +175,117 @@ func TestFloor(t *testing.T) {
 	assert.Equal(t, 20, n.Key())
 }
 
+func TestBracket(t *testing.T) {
+	tree := rbts.New[int, string]()
+	_, _, hasFloor, hasCeiling := rbts.Bracket(tree, 5)
+	assert.False(t, hasFloor)
+	assert.False(t, hasCeiling)
+
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, "")
+	}
+
+	floor, ceiling, hasFloor, hasCeiling := rbts.Bracket(tree, 5)
+	assert.False(t, hasFloor, "below all keys")
+	assert.Nil(t, floor)
+	require.True(t, hasCeiling)
+	assert.Equal(t, 10, ceiling.Key())
+
+	floor, ceiling, hasFloor, hasCeiling = rbts.Bracket(tree, 35)
+	require.True(t, hasFloor, "above all keys")
+	assert.Equal(t, 30, floor.Key())
+	assert.False(t, hasCeiling)
+	assert.Nil(t, ceiling)
+
+	floor, ceiling, hasFloor, hasCeiling = rbts.Bracket(tree, 20)
+	require.True(t, hasFloor, "exact match")
+	require.True(t, hasCeiling)
+	assert.Equal(t, 20, floor.Key())
+	assert.Same(t, floor, ceiling)
+
+	floor, ceiling, hasFloor, hasCeiling = rbts.Bracket(tree, 25)
+	require.True(t, hasFloor, "strictly between keys")
+	require.True(t, hasCeiling)
+	assert.Equal(t, 20, floor.Key())
+	assert.Equal(t, 30, ceiling.Key())
+}
+
+func TestNearestN(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.Empty(t, rbts.NearestN(tree, 5, 3))
+
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+	keys := func(nodes []*rbts.Node[int, string]) []int {
+		var out []int
+		for _, n := range nodes {
+			out = append(out, n.Key())
+		}
+		return out
+	}
+
+	assert.Equal(t, []int{30, 40, 20}, keys(rbts.NearestN(tree, 33, 3)))
+	assert.Equal(t, []int{30, 20, 40}, keys(rbts.NearestN(tree, 30, 3)), "exact match first, then the tie goes to the smaller key")
+	assert.Equal(t, []int{20, 30}, keys(rbts.NearestN(tree, 25, 2)), "ties prefer the smaller key")
+	assert.Equal(t, []int{10, 20}, keys(rbts.NearestN(tree, -100, 2)))
+	assert.Equal(t, []int{50, 40}, keys(rbts.NearestN(tree, 100, 2)))
+	assert.Equal(t, []int{40, 50, 30, 20, 10}, keys(rbts.NearestN(tree, 45, 10)), "n larger than the tree")
+	assert.Empty(t, rbts.NearestN(tree, 30, 0))
+
+	multi := rbts.NewMulti[uint, string]()
+	for _, v := range []uint{1, 5, 5, 5, 9} {
+		rbts.Insert(multi, v, "")
+	}
+	near := rbts.NearestN(multi, 5, 4)
+	require.Len(t, near, 4)
+	for _, n := range near[:3] {
+		assert.Equal(t, uint(5), n.Key())
+	}
+	assert.Equal(t, uint(1), near[3].Key())
+}
+
+func TestNearestNIntegerLimits(t *testing.T) {
+	keys := func(nodes []*rbts.Node[int64, string]) []int64 {
+		var out []int64
+		for _, n := range nodes {
+			out = append(out, n.Key())
+		}
+		return out
+	}
+
+	tree := rbts.New[int64, string]()
+	rbts.Insert(tree, math.MinInt64+1, "")
+	rbts.Insert(tree, 10, "")
+	assert.Equal(t, []int64{10}, keys(rbts.NearestN(tree, 5, 1)))
+	assert.Equal(t, []int64{10, math.MinInt64 + 1}, keys(rbts.NearestN(tree, 5, 2)))
+
+	tree = rbts.New[int64, string]()
+	rbts.Insert(tree, -10, "")
+	rbts.Insert(tree, math.MaxInt64, "")
+	assert.Equal(t, []int64{-10}, keys(rbts.NearestN(tree, -5, 1)))
+
+	tree = rbts.New[int64, string]()
+	rbts.Insert(tree, math.MinInt64, "")
+	rbts.Insert(tree, math.MaxInt64, "")
+	assert.Equal(t, []int64{math.MinInt64}, keys(rbts.NearestN(tree, -1, 1)))
+	assert.Equal(t, []int64{math.MaxInt64}, keys(rbts.NearestN(tree, 1, 1)))
+
+	small := rbts.New[int8, string]()
+	rbts.Insert(small, -128, "")
+	rbts.Insert(small, 100, "")
+	n := rbts.NearestN(small, 0, 1)
+	require.Len(t, n, 1)
+	assert.Equal(t, int8(100), n[0].Key())
+
+	unsigned := rbts.New[uint8, string]()
+	rbts.Insert(unsigned, 0, "")
+	rbts.Insert(unsigned, 255, "")
+	u := rbts.NearestN(unsigned, 200, 1)
+	require.Len(t, u, 1)
+	assert.Equal(t, uint8(255), u[0].Key())
+}
+
 func TestHigher(t *testing.T) {
 	tree := rbts.New[int, string]()
 	for _, v := range []int{10, 20, 30} {
@@ -219,6 +379,30 @@ func TestRange(t *testing.T) {
 	}
 }
 
+func TestRangeBounds(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+
+	collect := func(from, to int) []int {
+		keys := []int{}
+		for n := range rbts.Range(tree, from, to) {
+			keys = append(keys, n.Key())
+		}
+		return keys
+	}
+
+	assert.Empty(t, collect(30, 30), "from == to is empty even on an existing key")
+	assert.Empty(t, collect(25, 25))
+	assert.Empty(t, collect(45, 15), "reversed bounds")
+	assert.Empty(t, collect(50, 10))
+	assert.Equal(t, []int{30}, collect(30, 31))
+	assert.Equal(t, []int{10, 20, 30, 40, 50}, collect(-100, 100), "bounds outside the key domain")
+	assert.Empty(t, collect(60, 100), "entirely above the keys")
+	assert.Empty(t, collect(-100, 10), "entirely below the keys")
+}
+
 func TestRank(t *testing.T) {
 	tree := rbts.New[int, string]()
 	values := []int{10, 20, 30, 40, 50}
@@ -250,224 +434,4301 @@ func TestKth(t *testing.T) {
 	assert.False(t, ok)
 }
 
-func ExampleNew() {
+func TestFilter(t *testing.T) {
 	tree := rbts.New[int, string]()
-	fmt.Println(rbts.Len(tree))
-	// Output: 0
-}
+	for i := range 20 {
+		rbts.Insert(tree, i, fmt.Sprint(i))
+	}
 
-func ExampleLen() {
-	tree := rbts.New[int, string]()
-	fmt.Println(rbts.Len(tree))
-	// Output: 0
-}
+	even := rbts.Filter(tree, func(k int, _ string) bool { return k%2 == 0 })
+	assert.True(t, rbts.IsValid(even))
+	assert.Equal(t, 10, rbts.Len(even))
+	assert.Equal(t, 20, rbts.Len(tree), "source tree should be unchanged")
 
-func ExampleInsert() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 10, "ten")
-	rbts.Insert(tree, 5, "five")
-	rbts.Insert(tree, 15, "fifteen")
-	fmt.Println(rbts.Len(tree))
-	// Output: 3
-}
+	i := 0
+	for n := range rbts.InOrder(even) {
+		assert.Equal(t, i*2, n.Key())
+		assert.Equal(t, fmt.Sprint(i*2), n.Value())
+		kth, ok := rbts.Kth(even, i)
+		require.True(t, ok)
+		assert.Equal(t, n.Key(), kth.Key())
+		i++
+	}
 
-func ExampleDelete() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 10, "ten")
-	rbts.Delete(tree, 10)
-	fmt.Println(rbts.Len(tree))
-	// Output: 0
-}
+	none := rbts.Filter(tree, func(int, string) bool { return false })
+	assert.Nil(t, none.Root)
+	assert.Equal(t, 0, rbts.Len(none))
 
-func ExampleSearch() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 20, "twenty")
-	node, found := rbts.Search(tree, 20)
-	fmt.Println(found, node.Value())
-	// Output: true twenty
+	// every result size, including full and partial deepest levels
+	for limit := range 21 {
+		below := rbts.Filter(tree, func(k int, _ string) bool { return k < limit })
+		assert.True(t, rbts.IsValid(below), "%d nodes", limit)
+		assert.Equal(t, limit, rbts.Len(below))
+	}
 }
 
-func ExampleMin() {
+func TestDepth(t *testing.T) {
 	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 20, "")
-	rbts.Insert(tree, 10, "")
-	min, ok := rbts.Min(tree)
-	if ok {
-		fmt.Println(min.Key())
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
 	}
-	// Output: 10
-}
 
-func ExampleMax() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 20, "")
-	rbts.Insert(tree, 30, "")
-	max, ok := rbts.Max(tree)
-	if ok {
-		fmt.Println(max.Key())
+	expected := map[int]int{20: 0, 10: 1, 40: 1, 30: 2, 50: 2}
+	for k, want := range expected {
+		d, ok := rbts.Depth(tree, k)
+		require.True(t, ok)
+		assert.Equal(t, want, d, "depth of %d", k)
 	}
-	// Output: 30
+
+	_, ok := rbts.Depth(tree, 25)
+	assert.False(t, ok)
 }
 
-func ExampleCeiling() {
+func TestPath(t *testing.T) {
 	tree := rbts.New[int, string]()
-	for _, v := range []int{10, 20, 30} {
+	for _, v := range []int{10, 20, 30, 40, 50} {
 		rbts.Insert(tree, v, "")
 	}
 
-	n, _ := rbts.Ceiling(tree, 15)
-	fmt.Println(n.Key())
-	n, _ = rbts.Ceiling(tree, 20)
-	fmt.Println(n.Key())
-	// Output:
-	// 20
-	// 20
-}
+	path, ok := rbts.Path(tree, 30)
+	require.True(t, ok)
+	var keys []int
+	for _, n := range path {
+		keys = append(keys, n.Key())
+	}
+	assert.Equal(t, []int{20, 40, 30}, keys)
 
-func ExampleFloor() {
-	tree := rbts.New[int, string]()
-	for _, v := range []int{10, 20, 30} {
-		rbts.Insert(tree, v, "")
+	path, ok = rbts.Path(tree, 35)
+	assert.False(t, ok)
+	keys = keys[:0]
+	for _, n := range path {
+		keys = append(keys, n.Key())
 	}
+	assert.Equal(t, []int{20, 40, 30}, keys)
 
-	n, _ := rbts.Floor(tree, 25)
-	fmt.Println(n.Key())
-	n, _ = rbts.Floor(tree, 20)
-	fmt.Println(n.Key())
-	// Output:
-	// 20
-	// 20
+	path, ok = rbts.Path(rbts.New[int, string](), 1)
+	assert.False(t, ok)
+	assert.Empty(t, path)
 }
 
-func ExampleHigher() {
-	tree := rbts.New[int, string]()
-	for _, v := range []int{10, 20, 30} {
-		rbts.Insert(tree, v, "")
-	}
+func TestRangeSum(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	summed := rbts.NewSummed[int, int]()
+	plain := rbts.New[int, int]()
+	for range 2000 {
+		k, v := r.Intn(200), r.Intn(100)
+		if r.Intn(3) == 0 {
+			rbts.Delete(summed, k)
+			rbts.Delete(plain, k)
+		} else {
+			rbts.Insert(summed, k, v)
+			rbts.Insert(plain, k, v)
+		}
 
-	n, _ := rbts.Higher(tree, 15)
-	fmt.Println(n.Key())
-	n, _ = rbts.Higher(tree, 20)
-	fmt.Println(n.Key())
-	// Output:
-	// 20
-	// 30
+		from, to := r.Intn(220)-10, r.Intn(220)-10
+		expected := 0
+		for n := range rbts.Range(summed, from, to) {
+			expected += n.Value()
+		}
+		require.Equal(t, expected, rbts.RangeSum(summed, from, to), "sum of [%d, %d)", from, to)
+		require.Equal(t, expected, rbts.RangeSum(plain, from, to), "unsummed sum of [%d, %d)", from, to)
+	}
 }
 
-func ExampleLower() {
-	tree := rbts.New[int, string]()
-	for _, v := range []int{10, 20, 30} {
-		rbts.Insert(tree, v, "")
+func TestSummedAllocs(t *testing.T) {
+	fill := func(tree *rbts.Tree[int, int]) {
+		for i := range 100 {
+			rbts.Insert(tree, i*37%100, i)
+		}
 	}
+	allocs := testing.AllocsPerRun(20, func() { fill(rbts.NewSummed[int, int]()) })
+	assert.LessOrEqual(t, allocs, 1+2*100.0, "one node and one sum per key")
 
-	n, _ := rbts.Lower(tree, 15)
-	fmt.Println(n.Key())
-	n, _ = rbts.Lower(tree, 20)
-	fmt.Println(n.Key())
-	// Output:
-	// 10
-	// 10
+	tree := rbts.NewSummed[int, int]()
+	fill(tree)
+	allocs = testing.AllocsPerRun(20, func() {
+		rbts.Insert(tree, 50, 1)
+		rbts.Update(tree, 99, 2)
+	})
+	assert.Zero(t, allocs, "updating sums in place should not allocate")
 }
 
-func ExamplePredecessor() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 20, "")
-	rbts.Insert(tree, 10, "")
-	node, _ := rbts.Search(tree, 20)
-	pred, ok := rbts.Predecessor(node)
-	if ok {
-		fmt.Println(pred.Key())
+func TestSummedRootSwapPanics(t *testing.T) {
+	summed := rbts.NewSummed[int, int]()
+	lengths := rbts.NewAggregated("", func(int, int) string { return "x" }, func(a, b string) string { return a + b })
+	for i := range 10 {
+		rbts.Insert(summed, i, i)
+		rbts.Insert(lengths, i, i)
 	}
-	// Output: 10
+	summed.Root = lengths.Root
+	assert.Panics(t, func() { rbts.RangeSum(summed, 0, 10) }, "foreign subtree data is never misread")
 }
 
-func ExampleSuccessor() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 20, "")
-	rbts.Insert(tree, 30, "")
-	node, _ := rbts.Search(tree, 20)
-	succ, ok := rbts.Successor(node)
-	if ok {
-		fmt.Println(succ.Key())
+func TestSampleWeighted(t *testing.T) {
+	summed := rbts.NewSummed[string, int]()
+	plain := rbts.New[string, int]()
+	weights := map[string]int{"a": 1, "b": 2, "c": 0, "d": 7}
+	for k, w := range weights {
+		rbts.Insert(summed, k, w)
+		rbts.Insert(plain, k, w)
 	}
-	// Output: 30
-}
 
-func ExampleInOrder() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 20, "")
-	rbts.Insert(tree, 10, "")
-	rbts.Insert(tree, 30, "")
-	for n := range rbts.InOrder(tree) {
-		fmt.Print(n.Key(), " ")
+	cases := []struct {
+		r    float64
+		want string
+		ok   bool
+	}{
+		{0, "a", true}, {0.99, "a", true}, {1, "b", true}, {2.99, "b", true},
+		{3, "d", true}, {9.99, "d", true}, {10, "", false}, {-0.5, "", false},
+	}
+	for _, tree := range []*rbts.Tree[string, int]{summed, plain} {
+		for _, c := range cases {
+			got, ok := rbts.SampleWeighted(tree, c.r)
+			assert.Equal(t, c.ok, ok, "r=%v", c.r)
+			assert.Equal(t, c.want, got, "r=%v", c.r)
+		}
 	}
-	fmt.Println()
-	// Output: 10 20 30
-}
 
-func ExampleRange() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 10, "")
-	rbts.Insert(tree, 20, "")
-	rbts.Insert(tree, 30, "")
-	for n := range rbts.Range(tree, 15, 25) {
-		fmt.Print(n.Key(), " ")
+	rng := rand.New(rand.NewSource(101))
+	counts := map[string]int{}
+	const draws = 100_000
+	for range draws {
+		k, ok := rbts.SampleWeighted(summed, rng.Float64()*10)
+		require.True(t, ok)
+		counts[k]++
+	}
+	for k, w := range weights {
+		assert.InDelta(t, float64(w)/10, float64(counts[k])/draws, 0.01, "key %s", k)
 	}
-	fmt.Println()
-	// Output: 20
 }
 
-func ExampleRank() {
+func TestInsertNode(t *testing.T) {
 	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 10, "")
-	rbts.Insert(tree, 20, "")
-	rank := rbts.Rank(tree, 15)
-	fmt.Println(rank)
-	// Output: 1
+	r := rand.New(rand.NewSource(91))
+	for _, k := range r.Perm(100) {
+		n, inserted := rbts.InsertNode(tree, k, fmt.Sprint(k))
+		require.True(t, inserted)
+		require.Equal(t, k, n.Key())
+		require.Equal(t, fmt.Sprint(k), n.Value())
+		found, _ := rbts.Search(tree, k)
+		require.Same(t, found, n, "returned node is the one in the tree")
+	}
+	assert.True(t, rbts.IsValid(tree))
+
+	before, _ := rbts.Search(tree, 42)
+	n, inserted := rbts.InsertNode(tree, 42, "updated")
+	assert.False(t, inserted)
+	assert.Same(t, before, n, "replacing a value keeps the node")
+	assert.Equal(t, 42, n.Key())
+	assert.Equal(t, "updated", n.Value())
+	assert.Equal(t, 42, rbts.RankOfNode(n))
+	assert.Equal(t, 100, rbts.Len(tree))
+
+	multi := rbts.NewMulti[int, string]()
+	a, _ := rbts.InsertNode(multi, 1, "a")
+	b, inserted := rbts.InsertNode(multi, 1, "b")
+	assert.True(t, inserted, "multi trees always insert")
+	assert.NotSame(t, a, b)
+	next, ok := rbts.Successor(a)
+	require.True(t, ok)
+	assert.Same(t, b, next)
 }
 
-func ExampleKth() {
-	tree := rbts.New[int, string]()
-	rbts.Insert(tree, 10, "")
-	rbts.Insert(tree, 20, "")
-	n, _ := rbts.Kth(tree, 1)
-	fmt.Println(n.Key())
-	// Output: 20
+func TestInsertChecked(t *testing.T) {
+	tree := rbts.New[float64, string]()
+	inserted, err := rbts.InsertChecked(tree, 1.5, "a")
+	require.NoError(t, err)
+	assert.True(t, inserted)
+	inserted, err = rbts.InsertChecked(tree, 1.5, "b")
+	require.NoError(t, err)
+	assert.False(t, inserted)
+
+	inserted, err = rbts.InsertChecked(tree, math.NaN(), "nan")
+	assert.Error(t, err)
+	assert.False(t, inserted)
+	assert.Equal(t, 1, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+
+	_, err = rbts.InsertChecked(tree, math.Inf(-1), "-inf")
+	assert.NoError(t, err)
+
+	ints := rbts.New[int, int]()
+	_, err = rbts.InsertChecked(ints, 0, 0)
+	assert.NoError(t, err)
 }
 
-func BenchmarkInsertRandom(b *testing.B) {
-	r := rand.New(rand.NewSource(42))
+func TestInsertMulti(t *testing.T) {
 	tree := rbts.New[int, string]()
-	keys := make([]int, b.N)
-	for i := range keys {
-		keys[i] = r.Intn(1_000_000)
+	rbts.Insert(tree, 10, "ten")
+	rbts.Insert(tree, 30, "thirty")
+	for range 3 {
+		rbts.InsertMulti(tree, 20, "twenty")
 	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		rbts.Insert(tree, keys[i], "value")
+
+	assert.Equal(t, 5, rbts.Len(tree))
+	assert.Equal(t, 3, rbts.Count(tree, 20))
+	assert.Equal(t, 1, rbts.Rank(tree, 20))
+	assert.Equal(t, 4, rbts.Rank(tree, 30))
+	for k := 1; k <= 3; k++ {
+		n, ok := rbts.Kth(tree, k)
+		require.True(t, ok)
+		assert.Equal(t, 20, n.Key())
 	}
-}
 
-func BenchmarkInsertSequential(b *testing.B) {
-	tree := rbts.New[int, string]()
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		rbts.Insert(tree, i, "value")
+	for want := 2; want >= 0; want-- {
+		assert.True(t, rbts.Delete(tree, 20))
+		assert.Equal(t, want, rbts.Count(tree, 20))
+		assert.Equal(t, 2+want, rbts.Len(tree))
 	}
+	assert.False(t, rbts.Delete(tree, 20))
 }
 
-func BenchmarkSearchHit(b *testing.B) {
-	tree := rbts.New[int, string]()
-	for i := 0; i < 1000; i++ {
-		rbts.Insert(tree, i, "value")
+func TestMultiFIFO(t *testing.T) {
+	tree := rbts.NewMulti[int, int]()
+	want := map[int][]int{}
+	r := rand.New(rand.NewSource(105))
+	for seq := range 3000 {
+		key := r.Intn(8)
+		if r.Intn(3) == 0 {
+			rbts.Delete(tree, key)
+			if len(want[key]) > 0 {
+				want[key] = want[key][1:]
+			}
+			continue
+		}
+		rbts.Insert(tree, key, seq)
+		want[key] = append(want[key], seq)
 	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		rbts.Search(tree, i%1000)
+	require.True(t, rbts.IsValid(tree))
+
+	got := map[int][]int{}
+	for n := range rbts.InOrder(tree) {
+		got[n.Key()] = append(got[n.Key()], n.Value())
+	}
+	for key, seqs := range want {
+		if len(seqs) == 0 {
+			assert.Empty(t, got[key])
+			continue
+		}
+		assert.Equal(t, seqs, got[key], "key %d yields duplicates first in, first out", key)
 	}
 }
 
-func BenchmarkSearchMiss(b *testing.B) {
+func TestCount(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.Equal(t, 0, rbts.Count(tree, 1))
+
+	r := rand.New(rand.NewSource(3))
+	counts := map[int]int{}
+	for range 500 {
+		k := r.Intn(20)
+		rbts.InsertMulti(tree, k, "")
+		counts[k]++
+	}
+	for k := -1; k <= 20; k++ {
+		assert.Equal(t, counts[k], rbts.Count(tree, k), "count of %d", k)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 5 {
+		rbts.Insert(tree, i*10, "")
+	}
+
+	n, err := rbts.Select(tree, 3)
+	require.NoError(t, err)
+	assert.Equal(t, 30, n.Key())
+
+	n, err = rbts.Select(tree, 7)
+	assert.Nil(t, n)
+	assert.EqualError(t, err, "redblacktrees: rank 7 out of range for tree of size 5")
+
+	_, err = rbts.Select(tree, -1)
+	assert.Error(t, err)
+}
+
+func TestSelectEntry(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{30, 10, 50, 20, 40} {
+		rbts.Insert(tree, v, fmt.Sprint(v))
+	}
+
+	k, v, ok := rbts.SelectEntry(tree, 0)
+	require.True(t, ok)
+	assert.Equal(t, 10, k)
+	assert.Equal(t, "10", v)
+
+	k, v, ok = rbts.SelectEntry(tree, rbts.Len(tree)-1)
+	require.True(t, ok)
+	assert.Equal(t, 50, k)
+	assert.Equal(t, "50", v)
+
+	_, _, ok = rbts.SelectEntry(tree, rbts.Len(tree))
+	assert.False(t, ok)
+	_, _, ok = rbts.SelectEntry(tree, -1)
+	assert.False(t, ok)
+}
+
+func TestQuantile(t *testing.T) {
+	tree := rbts.New[int, string]()
+	_, _, ok := rbts.Quantile(tree, 0.5)
+	assert.False(t, ok)
+
+	for i := 1; i <= 101; i++ {
+		rbts.Insert(tree, i, "")
+	}
+
+	k, _, ok := rbts.Quantile(tree, 0)
+	require.True(t, ok)
+	assert.Equal(t, 1, k)
+
+	k, _, ok = rbts.Quantile(tree, 0.5)
+	require.True(t, ok)
+	assert.Equal(t, 51, k)
+
+	k, _, ok = rbts.Quantile(tree, 0.999)
+	require.True(t, ok)
+	assert.Equal(t, 100, k, "positions round down")
+
+	k, _, ok = rbts.Quantile(tree, 1.0)
+	require.True(t, ok)
+	assert.Equal(t, 101, k)
+
+	_, _, ok = rbts.Quantile(tree, -0.1)
+	assert.False(t, ok)
+	_, _, ok = rbts.Quantile(tree, 1.1)
+	assert.False(t, ok)
+}
+
+func TestQueryRange(t *testing.T) {
+	r := rand.New(rand.NewSource(11))
+	concat := rbts.NewAggregated("", func(k int, _ string) string { return fmt.Sprint(k, ",") }, func(a, b string) string { return a + b })
+	maxOf := rbts.NewAggregated(-1, func(_ int, v string) int { return len(v) }, func(a, b int) int { return max(a, b) })
+	for range 1500 {
+		k, v := r.Intn(100), strings.Repeat("x", r.Intn(10))
+		if r.Intn(3) == 0 {
+			rbts.Delete(concat, k)
+			rbts.Delete(maxOf, k)
+		} else {
+			rbts.Insert(concat, k, v)
+			rbts.Insert(maxOf, k, v)
+		}
+
+		from, to := r.Intn(110)-5, r.Intn(110)-5
+		wantConcat, wantMax := "", -1
+		for n := range rbts.Range(concat, from, to) {
+			wantConcat += fmt.Sprint(n.Key(), ",")
+			wantMax = max(wantMax, len(n.Value()))
+		}
+		require.Equal(t, wantConcat, rbts.QueryRange[int, string, string](concat, from, to))
+		require.Equal(t, wantMax, rbts.QueryRange[int, string, int](maxOf, from, to))
+	}
+
+	assert.Panics(t, func() { rbts.QueryRange[int, string, int](concat, 0, 1) })
+}
+
+func TestAggregatedAllocs(t *testing.T) {
+	sum := func(a, b int) int { return a + b }
+	fill := func(tree *rbts.Tree[int, int]) {
+		for i := range 100 {
+			rbts.Insert(tree, i*37%100, i)
+		}
+	}
+	allocs := testing.AllocsPerRun(20, func() {
+		fill(rbts.NewAggregated(0, func(_, v int) int { return v }, sum))
+	})
+	assert.LessOrEqual(t, allocs, 2+2*100.0, "one node and one aggregate per key")
+
+	tree := rbts.NewAggregated(0, func(_, v int) int { return v }, sum)
+	fill(tree)
+	allocs = testing.AllocsPerRun(20, func() {
+		rbts.Insert(tree, 50, 1)
+		rbts.Update(tree, 99, 2)
+	})
+	assert.Zero(t, allocs, "updating aggregates in place should not allocate")
+}
+
+func TestOverlapping(t *testing.T) {
+	type span struct{ end int }
+	endOf := func(s span) int { return s.end }
+	tree := rbts.NewIntervals(endOf)
+	for range rbts.Overlapping(tree, 0, 100) {
+		t.Fatal("empty tree should yield nothing")
+	}
+
+	r := rand.New(rand.NewSource(99))
+	for range 400 {
+		start := r.Intn(1000)
+		rbts.Insert(tree, start, span{start + 1 + r.Intn(50)})
+	}
+	for range 150 {
+		rbts.Delete(tree, r.Intn(1000))
+	}
+	for range 50 {
+		// widen some intervals in place to exercise updates of existing keys
+		start := r.Intn(1000)
+		rbts.Update(tree, start, span{start + 200})
+	}
+	require.True(t, rbts.IsValid(tree))
+
+	for range 200 {
+		lo := r.Intn(1100) - 50
+		hi := lo + 1 + r.Intn(60)
+		var want, got []int
+		for n := range rbts.InOrder(tree) {
+			if n.Key() < hi && n.Value().end > lo {
+				want = append(want, n.Key())
+			}
+		}
+		for n := range rbts.Overlapping(tree, lo, hi) {
+			got = append(got, n.Key())
+		}
+		require.Equal(t, want, got, "lo=%d hi=%d", lo, hi)
+	}
+
+	touching := rbts.NewIntervals(endOf)
+	rbts.Insert(touching, 10, span{20})
+	for range rbts.Overlapping(touching, 20, 30) {
+		t.Fatal("half-open intervals that only touch do not overlap")
+	}
+	for range rbts.Overlapping(touching, 0, 10) {
+		t.Fatal("half-open intervals that only touch do not overlap")
+	}
+	assert.Panics(t, func() { rbts.Overlapping(rbts.New[int, span](), 0, 1) })
+}
+
+func TestRangeMeanVariance(t *testing.T) {
+	tree := rbts.NewMoments[int, float64]()
+	_, ok := rbts.RangeMean(tree, 0, 100)
+	assert.False(t, ok)
+	_, ok = rbts.RangeVariance(tree, 0, 100)
+	assert.False(t, ok)
+
+	r := rand.New(rand.NewSource(96))
+	for range 500 {
+		rbts.Insert(tree, r.Intn(1000), r.Float64()*100)
+	}
+	for i := range 200 {
+		rbts.Delete(tree, i*5)
+	}
+	require.True(t, rbts.IsValid(tree))
+
+	for range 200 {
+		from, to := r.Intn(1100)-50, r.Intn(1100)-50
+		var values []float64
+		for n := range rbts.Range(tree, from, to) {
+			values = append(values, n.Value())
+		}
+		mean, ok := rbts.RangeMean(tree, from, to)
+		variance, vok := rbts.RangeVariance(tree, from, to)
+		require.Equal(t, len(values) > 0, ok)
+		require.Equal(t, ok, vok)
+		if !ok {
+			continue
+		}
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		wantMean := sum / float64(len(values))
+		var sq float64
+		for _, v := range values {
+			sq += (v - wantMean) * (v - wantMean)
+		}
+		assert.InDelta(t, wantMean, mean, 1e-9)
+		assert.InDelta(t, sq/float64(len(values)), variance, 1e-6)
+	}
+
+	m := rbts.QueryRange[int, float64, rbts.Moments](tree, 0, 1000)
+	assert.Equal(t, rbts.Len(tree), m.Count)
+}
+
+func TestKthInRange(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 10 {
+		rbts.Insert(tree, i*10, "")
+	}
+
+	n, ok := rbts.KthInRange(tree, 25, 75, 0)
+	require.True(t, ok)
+	assert.Equal(t, 30, n.Key())
+	n, ok = rbts.KthInRange(tree, 25, 75, 3)
+	require.True(t, ok)
+	assert.Equal(t, 60, n.Key())
+	n, ok = rbts.KthInRange(tree, 30, 70, 3)
+	require.True(t, ok, "from is inclusive")
+	assert.Equal(t, 60, n.Key())
+
+	_, ok = rbts.KthInRange(tree, 30, 70, 4)
+	assert.False(t, ok, "to is exclusive")
+	_, ok = rbts.KthInRange(tree, 25, 75, -1)
+	assert.False(t, ok)
+	_, ok = rbts.KthInRange(tree, 75, 25, 0)
+	assert.False(t, ok, "empty range")
+	_, ok = rbts.KthInRange(tree, 91, 200, 0)
+	assert.False(t, ok)
+
+	r := rand.New(rand.NewSource(103))
+	for range 100 {
+		from, to := r.Intn(110)-5, r.Intn(110)-5
+		var want []int
+		for n := range rbts.Range(tree, from, to) {
+			want = append(want, n.Key())
+		}
+		for k := range len(want) + 1 {
+			n, ok := rbts.KthInRange(tree, from, to, k)
+			if k == len(want) {
+				require.False(t, ok)
+				continue
+			}
+			require.True(t, ok)
+			require.Equal(t, want[k], n.Key())
+		}
+	}
+}
+
+func TestRankRange(t *testing.T) {
+	r := rand.New(rand.NewSource(5))
+	tree := rbts.New[int, string]()
+	for range 300 {
+		rbts.Insert(tree, r.Intn(1000), "")
+	}
+
+	for range 200 {
+		from, to := r.Intn(1100)-50, r.Intn(1100)-50
+		start, count := rbts.RankRange(tree, from, to)
+		assert.Equal(t, rbts.Rank(tree, from), start)
+
+		expected := 0
+		for range rbts.Range(tree, from, to) {
+			expected++
+		}
+		assert.Equal(t, expected, count, "count of [%d, %d)", from, to)
+	}
+}
+
+func TestRankOfNode(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{50, 20, 80, 10, 30, 70, 90, 60} {
+		rbts.Insert(tree, v, "")
+	}
+
+	for _, v := range []int{10, 20, 30, 50, 60, 70, 80, 90} {
+		n, found := rbts.Search(tree, v)
+		require.True(t, found)
+		assert.Equal(t, rbts.Rank(tree, v), rbts.RankOfNode(n), "rank of %d", v)
+	}
+
+	dups := rbts.New[int, string]()
+	for range 5 {
+		rbts.InsertMulti(dups, 1, "")
+	}
+	for i := range 5 {
+		n, ok := rbts.Kth(dups, i)
+		require.True(t, ok)
+		assert.Equal(t, i, rbts.RankOfNode(n))
+	}
+}
+
+func TestRankOfNodeInvertsKth(t *testing.T) {
+	tree := rbts.NewMulti[int, int]()
+	r := rand.New(rand.NewSource(100))
+	for i := range 600 {
+		rbts.Insert(tree, r.Intn(200), i)
+	}
+	for range 200 {
+		rbts.Delete(tree, r.Intn(200))
+	}
+
+	for k := range rbts.Len(tree) {
+		n, ok := rbts.Kth(tree, k)
+		require.True(t, ok)
+		require.Equal(t, k, rbts.RankOfNode(n))
+	}
+	for n := range rbts.InOrderNodes(tree) {
+		back, ok := rbts.Kth(tree, rbts.RankOfNode(n))
+		require.True(t, ok)
+		require.Same(t, n, back)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+	between := func(from, to int, incFrom, incTo bool) []int {
+		keys := []int{}
+		for n := range rbts.Between(tree, from, to, incFrom, incTo) {
+			keys = append(keys, n.Key())
+		}
+		return keys
+	}
+
+	assert.Equal(t, []int{30}, between(20, 40, false, false), "(a, b)")
+	assert.Equal(t, []int{20, 30, 40}, between(20, 40, true, true), "[a, b]")
+	assert.Equal(t, []int{30, 40}, between(20, 40, false, true), "(a, b]")
+	assert.Equal(t, []int{20, 30}, between(20, 40, true, false), "[a, b)")
+
+	assert.Equal(t, []int{30}, between(30, 30, true, true))
+	assert.Empty(t, between(30, 30, true, false))
+	assert.Empty(t, between(40, 20, true, true))
+	assert.Equal(t, []int{10, 20, 30, 40, 50}, between(0, 100, false, false))
+
+	multi := rbts.NewMulti[int, int]()
+	r := rand.New(rand.NewSource(93))
+	for i := range 300 {
+		rbts.Insert(multi, r.Intn(50), i)
+	}
+	for range 100 {
+		from, to := r.Intn(60)-5, r.Intn(60)-5
+		incFrom, incTo := r.Intn(2) == 0, r.Intn(2) == 0
+		var want, got []int
+		for n := range rbts.InOrder(multi) {
+			k := n.Key()
+			if (k > from || incFrom && k == from) && (k < to || incTo && k == to) {
+				want = append(want, n.Value())
+			}
+		}
+		for n := range rbts.Between(multi, from, to, incFrom, incTo) {
+			got = append(got, n.Value())
+		}
+		require.Equal(t, want, got, "from=%d to=%d incFrom=%v incTo=%v", from, to, incFrom, incTo)
+	}
+}
+
+func TestRangeReverse(t *testing.T) {
+	tree := rbts.NewMulti[int, int]()
+	r := rand.New(rand.NewSource(94))
+	for i := range 300 {
+		rbts.Insert(tree, r.Intn(100), i)
+	}
+	for range 100 {
+		from, to := r.Intn(110)-5, r.Intn(110)-5
+		var want, got []int
+		for n := range rbts.Range(tree, from, to) {
+			want = append(want, n.Value())
+		}
+		slices.Reverse(want)
+		for n := range rbts.RangeReverse(tree, from, to) {
+			got = append(got, n.Value())
+		}
+		require.Equal(t, want, got, "from=%d to=%d", from, to)
+	}
+
+	var got []int
+	for n := range rbts.RangeReverse(tree, 0, 100) {
+		got = append(got, n.Key())
+		if len(got) == 3 {
+			break
+		}
+	}
+	assert.Len(t, got, 3)
+	assert.True(t, slices.IsSortedFunc(got, func(a, b int) int { return b - a }))
+}
+
+func TestRangePage(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+	}
+
+	collect := func(from, to, offset, limit int) []int {
+		var keys []int
+		for n := range rbts.RangePage(tree, from, to, offset, limit) {
+			keys = append(keys, n.Key())
+		}
+		return keys
+	}
+
+	assert.Equal(t, []int{25, 26, 27}, collect(10, 50, 15, 3))
+	assert.Equal(t, []int{47, 48, 49}, collect(10, 50, 37, 10), "page truncated at the range end")
+	assert.Empty(t, collect(10, 50, 40, 10), "offset past the matches")
+	assert.Empty(t, collect(10, 50, 0, 0))
+	assert.Equal(t, []int{45, 46, 47, 48, 49}, collect(10, 50, 35, -1), "negative limit is unbounded")
+	assert.Equal(t, []int{10, 11}, collect(10, 50, -5, 2))
+	assert.Empty(t, collect(50, 10, 0, -1))
+}
+
+func TestCountLess(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+
+	assert.Equal(t, 0, rbts.CountLess(tree, 5))
+	assert.Equal(t, 0, rbts.CountLess(tree, 10))
+	assert.Equal(t, 2, rbts.CountLess(tree, 25))
+	assert.Equal(t, 2, rbts.CountLess(tree, 30))
+	assert.Equal(t, 5, rbts.CountLess(tree, 60))
+}
+
+func TestCountGreater(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+
+	assert.Equal(t, 5, rbts.CountGreater(tree, 5))
+	assert.Equal(t, 3, rbts.CountGreater(tree, 20))
+	assert.Equal(t, 3, rbts.CountGreater(tree, 25))
+	assert.Equal(t, 0, rbts.CountGreater(tree, 50))
+	assert.Equal(t, 0, rbts.CountGreater(rbts.New[int, string](), 0))
+}
+
+func TestRangeSlice(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 20 {
+		rbts.Insert(tree, i*5, fmt.Sprint(i))
+	}
+
+	nodes := rbts.RangeSlice(tree, 12, 40)
+	require.Len(t, nodes, 5)
+	assert.Equal(t, 5, cap(nodes), "slice should be pre-sized")
+	for i, n := range nodes {
+		assert.Equal(t, 15+i*5, n.Key())
+		assert.Equal(t, fmt.Sprint(3+i), n.Value())
+	}
+
+	assert.Empty(t, rbts.RangeSlice(tree, 40, 12))
+	assert.Empty(t, rbts.RangeSlice(tree, 200, 300))
+	assert.Len(t, rbts.RangeSlice(tree, 0, 100), 20)
+}
+
+func TestSplitRanges(t *testing.T) {
+	assert.Nil(t, rbts.SplitRanges(rbts.New[int, string](), 4))
+
+	tree := rbts.New[int, string]()
+	for i := range 10 {
+		rbts.Insert(tree, i*10, "")
+	}
+	assert.Equal(t, [][2]int{{0, 10}, {20, 40}, {50, 60}, {70, 90}}, rbts.SplitRanges(tree, 4))
+	assert.Equal(t, [][2]int{{0, 90}}, rbts.SplitRanges(tree, 1))
+	assert.Len(t, rbts.SplitRanges(tree, 50), 10, "n is capped at the size of the tree")
+	assert.Nil(t, rbts.SplitRanges(tree, 0))
+
+	covers := func(tree *rbts.Tree[int, int], chunks [][2]int) {
+		t.Helper()
+		var got []int
+		for i, c := range chunks {
+			if i > 0 {
+				require.Less(t, chunks[i-1][1], c[0], "chunks must not overlap")
+			}
+			for n := range rbts.Between(tree, c[0], c[1], true, true) {
+				got = append(got, n.Value())
+			}
+		}
+		var want []int
+		for n := range rbts.InOrder(tree) {
+			want = append(want, n.Value())
+		}
+		require.Equal(t, want, got, "chunks must cover every key once")
+	}
+
+	r := rand.New(rand.NewSource(101))
+	multi := rbts.NewMulti[int, int]()
+	for i := range 500 {
+		rbts.Insert(multi, r.Intn(100), i)
+	}
+	for _, n := range []int{1, 3, 7, 16, 99, 1000} {
+		chunks := rbts.SplitRanges(multi, n)
+		assert.LessOrEqual(t, len(chunks), n)
+		covers(multi, chunks)
+	}
+
+	plain := rbts.New[int, int]()
+	for i := range 1000 {
+		rbts.Insert(plain, r.Intn(1_000_000), i)
+	}
+	chunks := rbts.SplitRanges(plain, 8)
+	require.Len(t, chunks, 8)
+	covers(plain, chunks)
+	for _, c := range chunks {
+		count := rbts.CountRange(plain, c[0], c[1]+1)
+		assert.InDelta(t, rbts.Len(plain)/8, count, 1, "chunks are balanced")
+	}
+}
+
+func TestRangePrefix(t *testing.T) {
+	tree := rbts.New[string, int]()
+	words := []string{"app", "apple", "application", "apply", "apt", "banana", "ap", "b", "a"}
+	for i, w := range words {
+		rbts.Insert(tree, w, i)
+	}
+	collect := func(prefix string) []string {
+		var keys []string
+		for n := range rbts.RangePrefix(tree, prefix) {
+			keys = append(keys, n.Key())
+		}
+		return keys
+	}
+
+	assert.Equal(t, []string{"app", "apple", "application", "apply"}, collect("app"))
+	assert.Equal(t, []string{"ap", "app", "apple", "application", "apply", "apt"}, collect("ap"))
+	assert.Equal(t, []string{"b", "banana"}, collect("b"))
+	assert.Empty(t, collect("c"))
+	assert.Len(t, collect(""), len(words), "empty prefix matches everything")
+
+	rbts.Insert(tree, "\xff", 0)
+	rbts.Insert(tree, "\xff\xff", 0)
+	rbts.Insert(tree, "\xff\xffz", 0)
+	rbts.Insert(tree, "a\xff", 0)
+	rbts.Insert(tree, "a\xff\x01", 0)
+	assert.Equal(t, []string{"\xff\xff", "\xff\xffz"}, collect("\xff\xff"), "no upper bound for all-0xff prefix")
+	assert.Equal(t, []string{"a\xff", "a\xff\x01"}, collect("a\xff"))
+
+	var first []string
+	for n := range rbts.RangePrefix(tree, "ap") {
+		first = append(first, n.Key())
+		break
+	}
+	assert.Equal(t, []string{"ap"}, first)
+}
+
+func TestFirstN(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	tree := rbts.New[int, string]()
+	for range 50 {
+		rbts.Insert(tree, r.Intn(1000), "")
+	}
+	var sorted []int
+	for n := range rbts.InOrder(tree) {
+		sorted = append(sorted, n.Key())
+	}
+
+	for _, n := range []int{-1, 0, 1, 10, len(sorted), len(sorted) + 5} {
+		keys := []int{}
+		for node := range rbts.FirstN(tree, n) {
+			keys = append(keys, node.Key())
+		}
+		expected := sorted[:min(max(n, 0), len(sorted))]
+		assert.Equal(t, expected, keys, "n=%d", n)
+	}
+}
+
+func TestLastN(t *testing.T) {
+	r := rand.New(rand.NewSource(9))
+	tree := rbts.New[int, string]()
+	for range 50 {
+		rbts.Insert(tree, r.Intn(1000), "")
+	}
+	var sorted []int
+	for n := range rbts.InOrder(tree) {
+		sorted = append(sorted, n.Key())
+	}
+
+	for _, n := range []int{-1, 0, 1, 10, len(sorted), len(sorted) + 5} {
+		keys := []int{}
+		for node := range rbts.LastN(tree, n) {
+			keys = append(keys, node.Key())
+		}
+		expected := sorted[len(sorted)-min(max(n, 0), len(sorted)):]
+		assert.Equal(t, expected, keys, "n=%d", n)
+	}
+}
+
+func TestPartition(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 21 {
+		rbts.Insert(tree, i, fmt.Sprint(i))
+	}
+
+	matched, rest := rbts.Partition(tree, func(k int, v string) bool { return k%3 == 0 })
+	assert.Equal(t, 7, rbts.Len(matched))
+	assert.Equal(t, 14, rbts.Len(rest))
+	assert.Equal(t, 21, rbts.Len(tree), "source tree should be unchanged")
+
+	for n := range rbts.InOrder(matched) {
+		assert.Zero(t, n.Key()%3)
+	}
+	for n := range rbts.InOrder(rest) {
+		assert.NotZero(t, n.Key()%3)
+		assert.Equal(t, fmt.Sprint(n.Key()), n.Value())
+	}
+}
+
+func TestPartitionEvenOdd(t *testing.T) {
+	tree := rbts.New[int, string]()
+	r := rand.New(rand.NewSource(98))
+	for _, k := range r.Perm(500) {
+		rbts.Insert(tree, k, fmt.Sprint(k))
+	}
+
+	even, odd := rbts.Partition(tree, func(k int, _ string) bool { return k%2 == 0 })
+	require.NoError(t, rbts.CheckInvariants(even))
+	require.NoError(t, rbts.CheckInvariants(odd))
+	assert.Equal(t, 250, rbts.Len(even))
+	assert.Equal(t, 250, rbts.Len(odd))
+
+	joined := rbts.Clone(even)
+	rbts.Merge(joined, odd)
+	assert.True(t, rbts.Equal(tree, joined), "the two halves reproduce the original")
+}
+
+func TestGroupBy(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 20 {
+		rbts.Insert(tree, i, fmt.Sprint(i))
+	}
+
+	groups := rbts.GroupBy(tree, func(k int, _ string) int { return k % 3 })
+	require.Len(t, groups, 3)
+	assert.Equal(t, 7, rbts.Len(groups[0]))
+	assert.Equal(t, 7, rbts.Len(groups[1]))
+	assert.Equal(t, 6, rbts.Len(groups[2]))
+	assert.Equal(t, 20, rbts.Len(tree), "source tree should be unchanged")
+
+	for g, sub := range groups {
+		assert.True(t, rbts.IsValid(sub))
+		var keys []int
+		for n := range rbts.InOrder(sub) {
+			assert.Equal(t, g, n.Key()%3)
+			assert.Equal(t, fmt.Sprint(n.Key()), n.Value())
+			keys = append(keys, n.Key())
+		}
+		assert.True(t, slices.IsSorted(keys))
+	}
+
+	empty := rbts.GroupBy(rbts.New[int, string](), func(k int, _ string) int { return k })
+	assert.Empty(t, empty)
+}
+
+func TestIsSubset(t *testing.T) {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	assert.True(t, rbts.IsSubset(a, b), "empty set is a subset of itself")
+
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(b, v, "b")
+	}
+	assert.True(t, rbts.IsSubset(a, b))
+	assert.False(t, rbts.IsSubset(b, a))
+
+	for _, v := range []int{20, 40} {
+		rbts.Insert(a, v, "a")
+	}
+	assert.True(t, rbts.IsSubset(a, b), "values are not compared")
+	assert.True(t, rbts.IsSubset(b, b))
+
+	rbts.Insert(a, 45, "a")
+	assert.False(t, rbts.IsSubset(a, b))
+	rbts.Delete(a, 45)
+	rbts.Insert(a, 60, "a")
+	assert.False(t, rbts.IsSubset(a, b), "key past the end of b")
+}
+
+func TestIsSuperset(t *testing.T) {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(a, v, "")
+	}
+	rbts.Insert(b, 20, "")
+
+	assert.True(t, rbts.IsSuperset(a, b))
+	assert.False(t, rbts.IsSuperset(b, a))
+}
+
+func TestNewMulti(t *testing.T) {
+	tree := rbts.NewMulti[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	assert.True(t, rbts.Insert(tree, 20, "first"))
+	assert.True(t, rbts.Insert(tree, 20, "second"))
+	assert.True(t, rbts.Insert(tree, 20, "third"))
+	rbts.Insert(tree, 30, "thirty")
+
+	assert.Equal(t, 5, rbts.Len(tree))
+	assert.Equal(t, 3, rbts.Count(tree, 20))
+
+	var values []string
+	for n := range rbts.InOrder(tree) {
+		values = append(values, n.Value())
+	}
+	assert.Equal(t, []string{"ten", "first", "second", "third", "thirty"}, values, "equal keys keep insertion order")
+
+	for _, remaining := range [][]string{{"second", "third"}, {"third"}, nil} {
+		require.True(t, rbts.Delete(tree, 20))
+		var got []string
+		for n := range rbts.Range(tree, 20, 21) {
+			got = append(got, n.Value())
+		}
+		assert.Equal(t, remaining, got)
+		assert.Equal(t, len(remaining), rbts.Count(tree, 20))
+	}
+	assert.False(t, rbts.Delete(tree, 20))
+	assert.Equal(t, 2, rbts.Len(tree))
+}
+
+func TestAnyInRange(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.False(t, rbts.AnyInRange(tree, 0, 100))
+
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+	assert.True(t, rbts.AnyInRange(tree, 25, 35), "exactly one key")
+	assert.True(t, rbts.AnyInRange(tree, 30, 31))
+	assert.False(t, rbts.AnyInRange(tree, 31, 40), "none, to is exclusive")
+	assert.False(t, rbts.AnyInRange(tree, 0, 10))
+	assert.False(t, rbts.AnyInRange(tree, 51, 100))
+	assert.True(t, rbts.AnyInRange(tree, 0, 11), "straddles the min")
+	assert.True(t, rbts.AnyInRange(tree, 45, 100), "straddles the max")
+	assert.False(t, rbts.AnyInRange(tree, 40, 20), "empty range")
+
+	r := rand.New(rand.NewSource(100))
+	for range 200 {
+		from, to := r.Intn(70), r.Intn(70)
+		assert.Equal(t, rbts.CountRange(tree, from, to) > 0, rbts.AnyInRange(tree, from, to))
+	}
+}
+
+func TestCountRange(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+
+	assert.Equal(t, 1, rbts.Count(tree, 30))
+	assert.Equal(t, 0, rbts.Count(tree, 35))
+
+	assert.Equal(t, 5, rbts.CountRange(tree, 0, 100), "covers everything")
+	assert.Equal(t, 2, rbts.CountRange(tree, 20, 40), "half-open at both existing keys")
+	assert.Equal(t, 3, rbts.CountRange(tree, 15, 45))
+	assert.Equal(t, 0, rbts.CountRange(tree, 21, 29), "between keys")
+	assert.Equal(t, 0, rbts.CountRange(tree, 30, 30), "empty interval")
+	assert.Equal(t, 0, rbts.CountRange(tree, 40, 20), "reversed bounds")
+	assert.Equal(t, 1, rbts.CountRange(tree, 50, 51))
+
+	multi := rbts.NewMulti[int, string]()
+	for _, v := range []int{1, 2, 2, 2, 3} {
+		rbts.Insert(multi, v, "")
+	}
+	assert.Equal(t, 3, rbts.CountRange(multi, 2, 3))
+}
+
+func TestSymmetricDifference(t *testing.T) {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	for i := range 30 {
+		if i%2 == 0 {
+			rbts.Insert(a, i, "a")
+		}
+		if i%3 == 0 {
+			rbts.Insert(b, i, "b")
+		}
+	}
+
+	diff := rbts.SymmetricDifference(a, b)
+	var expected []int
+	for i := range 30 {
+		if (i%2 == 0) != (i%3 == 0) {
+			expected = append(expected, i)
+		}
+	}
+	var keys []int
+	for n := range rbts.InOrder(diff) {
+		keys = append(keys, n.Key())
+		if n.Key()%2 == 0 {
+			assert.Equal(t, "a", n.Value())
+		} else {
+			assert.Equal(t, "b", n.Value())
+		}
+	}
+	assert.Equal(t, expected, keys)
+	assert.Equal(t, len(expected), rbts.Len(diff))
+	for i, k := range expected {
+		assert.Equal(t, i, rbts.Rank(diff, k))
+	}
+
+	empty := rbts.SymmetricDifference(a, a)
+	assert.Equal(t, 0, rbts.Len(empty))
+}
+
+func TestReset(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 100 {
+		rbts.Insert(tree, i, fmt.Sprint(i))
+	}
+	held, found := rbts.Search(tree, 42)
+	require.True(t, found)
+
+	rbts.Reset(tree)
+	assert.Nil(t, tree.Root)
+	assert.Equal(t, 0, rbts.Len(tree))
+	assert.Equal(t, "", held.Value(), "recycled nodes should not retain old values")
+
+	for i := range 150 {
+		rbts.Insert(tree, i*2, "new")
+	}
+	assert.Equal(t, 150, rbts.Len(tree))
+	i := 0
+	for n := range rbts.InOrder(tree) {
+		assert.Equal(t, i*2, n.Key())
+		assert.Equal(t, "new", n.Value())
+		i++
+	}
+}
+
+func TestResetReusesNodes(t *testing.T) {
+	tree := rbts.New[int, string]()
+	fill := func() {
+		for i := range 32 {
+			rbts.Insert(tree, i, "")
+		}
+	}
+	fill()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		rbts.Reset(tree)
+		fill()
+	})
+	assert.Zero(t, allocs, "refilling after Reset reuses nodes")
+
+	allocs = testing.AllocsPerRun(100, func() {
+		rbts.Clear(tree)
+		fill()
+	})
+	assert.Equal(t, 32.0, allocs, "Clear releases the free list to the GC")
+}
+
+func TestMerge(t *testing.T) {
+	dst := rbts.New[int, string]()
+	src := rbts.New[int, string]()
+	for i := range 50 {
+		rbts.Insert(dst, i, "dst")
+	}
+	for i := 25; i < 100; i++ {
+		rbts.Insert(src, i, "src")
+	}
+
+	moved, _ := rbts.Search(src, 80)
+	rbts.Merge(dst, src)
+	require.True(t, rbts.IsValid(dst))
+	assert.Equal(t, 100, rbts.Len(dst))
+	assert.Zero(t, rbts.Len(src), "src is consumed")
+	for i := range 100 {
+		n, ok := rbts.Kth(dst, i)
+		require.True(t, ok)
+		assert.Equal(t, i, n.Key())
+		if i < 25 {
+			assert.Equal(t, "dst", n.Value())
+		} else {
+			assert.Equal(t, "src", n.Value(), "src wins on collisions")
+		}
+	}
+	n, _ := rbts.Search(dst, 80)
+	assert.Same(t, moved, n, "nodes of src are relinked, not copied")
+
+	rbts.Merge(dst, dst)
+	assert.Equal(t, 100, rbts.Len(dst))
+}
+
+func TestMergeRelinks(t *testing.T) {
+	a, b := rbts.New[int, int](), rbts.New[int, int]()
+	for i := range 200 {
+		rbts.Insert(b, i, i)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		// each run moves all 200 entries into the other, empty tree
+		rbts.Merge(a, b)
+		a, b = b, a
+	})
+	assert.LessOrEqual(t, allocs, 1.0, "only the slice of nodes is allocated")
+
+	multi := rbts.NewMulti[int, string]()
+	rbts.Insert(multi, 1, "dst")
+	more := rbts.NewMulti[int, string]()
+	rbts.Insert(more, 1, "src1")
+	rbts.Insert(more, 1, "src2")
+	rbts.Insert(more, 0, "src0")
+	rbts.Merge(multi, more)
+	require.True(t, rbts.IsValid(multi))
+	var got []string
+	for n := range rbts.InOrder(multi) {
+		got = append(got, n.Value())
+	}
+	assert.Equal(t, []string{"src0", "dst", "src1", "src2"}, got, "equal keys keep their order")
+
+	summed := rbts.NewSummed[int, int]()
+	rbts.Insert(summed, 5, 5)
+	plain := rbts.New[int, int]()
+	for i := range 10 {
+		rbts.Insert(plain, i, 1)
+	}
+	rbts.Merge(summed, plain)
+	require.True(t, rbts.IsValid(summed))
+	assert.Equal(t, 10, rbts.RangeSum(summed, 0, 10), "sums cover relinked nodes")
+}
+
+func TestRetainRange(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+	}
+
+	removed := rbts.RetainRange(tree, 20, 70)
+	assert.Equal(t, 50, removed)
+	assert.Equal(t, 50, rbts.Len(tree))
+	i := 20
+	for n := range rbts.InOrder(tree) {
+		assert.Equal(t, i, n.Key())
+		assert.Equal(t, i-20, rbts.Rank(tree, n.Key()))
+		i++
+	}
+	assert.Equal(t, 70, i)
+
+	assert.Equal(t, 0, rbts.RetainRange(tree, 0, 100), "nothing outside the range")
+	assert.Equal(t, 50, rbts.RetainRange(tree, 40, 40), "empty range removes everything")
+	assert.Equal(t, 0, rbts.Len(tree))
+}
+
+func TestDeleteMinMax(t *testing.T) {
+	tree := rbts.New[int, string]()
+	_, _, ok := rbts.DeleteMin(tree)
+	assert.False(t, ok)
+	_, _, ok = rbts.DeleteMax(tree)
+	assert.False(t, ok)
+
+	for i := range 10 {
+		rbts.Insert(tree, i, fmt.Sprint(i))
+	}
+	k, v, ok := rbts.DeleteMin(tree)
+	require.True(t, ok)
+	assert.Equal(t, 0, k)
+	assert.Equal(t, "0", v)
+	k, v, ok = rbts.DeleteMax(tree)
+	require.True(t, ok)
+	assert.Equal(t, 9, k)
+	assert.Equal(t, "9", v)
+	assert.Equal(t, 8, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+
+	multi := rbts.NewMulti[int, string]()
+	for _, v := range []string{"a", "b", "c"} {
+		rbts.Insert(multi, 1, v)
+	}
+	_, v, _ = rbts.DeleteMin(multi)
+	assert.Equal(t, "a", v)
+	_, v, _ = rbts.DeleteMax(multi)
+	assert.Equal(t, "c", v)
+}
+
+func TestCapped(t *testing.T) {
+	smallest := rbts.NewCapped[int, string](5, rbts.EvictMax)
+	r := rand.New(rand.NewSource(87))
+	for _, k := range r.Perm(100) {
+		smallest.Insert(k, fmt.Sprint(k))
+		require.LessOrEqual(t, rbts.Len(smallest.Tree()), 5)
+	}
+	var keys []int
+	for n := range rbts.InOrder(smallest.Tree()) {
+		keys = append(keys, n.Key())
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, keys)
+
+	k, _, evicted := smallest.Insert(50, "50")
+	assert.True(t, evicted, "a key above the current maximum is evicted at once")
+	assert.Equal(t, 50, k)
+
+	_, _, evicted = smallest.Insert(3, "three")
+	assert.False(t, evicted, "updating an existing key never evicts")
+	n, _ := rbts.Search(smallest.Tree(), 3)
+	assert.Equal(t, "three", n.Value())
+
+	largest := rbts.NewCapped[int, string](3, rbts.EvictMin)
+	for i := range 10 {
+		largest.Insert(i, "")
+	}
+	keys = nil
+	for n := range rbts.InOrder(largest.Tree()) {
+		keys = append(keys, n.Key())
+	}
+	assert.Equal(t, []int{7, 8, 9}, keys)
+	assert.True(t, rbts.IsValid(largest.Tree()))
+
+	assert.Panics(t, func() { rbts.NewCapped[int, string](0, rbts.EvictMax) })
+}
+
+func TestTimeTree(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tree := rbts.NewTimeTree[string]()
+	for _, h := range []int{5, 1, 3, 0, 4, 2} {
+		assert.True(t, tree.Insert(base.Add(time.Duration(h)*time.Hour), fmt.Sprint("event", h)))
+	}
+	assert.Equal(t, 6, tree.Len())
+
+	var got []string
+	prev := time.Time{}
+	for at, v := range tree.All() {
+		assert.True(t, at.After(prev), "entries are chronological")
+		prev = at
+		got = append(got, v)
+	}
+	assert.Equal(t, []string{"event0", "event1", "event2", "event3", "event4", "event5"}, got)
+
+	got = nil
+	for _, v := range tree.Range(base.Add(90*time.Minute), base.Add(4*time.Hour)) {
+		got = append(got, v)
+	}
+	assert.Equal(t, []string{"event2", "event3"}, got)
+
+	tokyo := time.FixedZone("JST", 9*60*60)
+	sameInstant := base.Add(time.Hour).In(tokyo)
+	v, ok := tree.Search(sameInstant)
+	require.True(t, ok, "times are compared as instants")
+	assert.Equal(t, "event1", v)
+
+	assert.False(t, tree.Insert(sameInstant, "replaced"))
+	for at, v := range tree.All() {
+		if v == "replaced" {
+			assert.Equal(t, tokyo, at.Location(), "the inserted time.Time is kept")
+		}
+	}
+
+	assert.True(t, tree.Delete(base))
+	assert.False(t, tree.Delete(base))
+	_, ok = tree.Search(base)
+	assert.False(t, ok)
+	assert.Equal(t, 5, tree.Len())
+}
+
+func TestTimeTreeFullRange(t *testing.T) {
+	times := []time.Time{
+		time.Date(-5000, 1, 1, 0, 0, 0, 0, time.UTC),
+		{},
+		time.Date(1600, 6, 1, 0, 0, 0, 999, time.UTC),
+		time.Date(1969, 12, 31, 23, 59, 59, 500, time.UTC),
+		time.Unix(0, 0),
+		time.Unix(0, 1),
+		time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(9999, 12, 31, 23, 59, 59, 999999999, time.UTC),
+	}
+	tree := rbts.NewTimeTree[int]()
+	for _, i := range rand.New(rand.NewSource(92)).Perm(len(times)) {
+		assert.True(t, tree.Insert(times[i], i))
+	}
+
+	var got []int
+	for at, i := range tree.All() {
+		assert.True(t, at.Equal(times[i]))
+		got = append(got, i)
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7}, got)
+
+	got = nil
+	for _, i := range tree.Range(time.Time{}, times[7]) {
+		got = append(got, i)
+	}
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6}, got)
+}
+
+func TestFromPairs(t *testing.T) {
+	pairs := []rbts.Pair[string, int]{
+		{"b", 1}, {"a", 2}, {"c", 3}, {"a", 4}, {"b", 5}, {"a", 6},
+	}
+	var calls [][2]int
+	tree, conflicts := rbts.FromPairs(pairs, func(existing, incoming int) int {
+		calls = append(calls, [2]int{existing, incoming})
+		return existing + incoming
+	})
+	assert.Equal(t, 3, conflicts)
+	assert.Equal(t, [][2]int{{2, 4}, {6, 6}, {1, 5}}, calls, "duplicates fold in input order")
+	assert.Equal(t, 3, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+	for k, want := range map[string]int{"a": 12, "b": 6, "c": 3} {
+		n, found := rbts.Search(tree, k)
+		require.True(t, found)
+		assert.Equal(t, want, n.Value())
+	}
+	assert.Equal(t, "b", pairs[0].Key, "input is left unchanged")
+
+	empty, conflicts := rbts.FromPairs[int, int](nil, nil)
+	assert.Zero(t, conflicts)
+	assert.Zero(t, rbts.Len(empty))
+
+	r := rand.New(rand.NewSource(92))
+	var many []rbts.Pair[int, int]
+	for i := range 1000 {
+		many = append(many, rbts.Pair[int, int]{Key: r.Intn(300), Value: i})
+	}
+	keepLatest := func(_, incoming int) int { return incoming }
+	tree2, conflicts := rbts.FromPairs(many, keepLatest)
+	assert.True(t, rbts.IsValid(tree2))
+	assert.Equal(t, 1000-rbts.Len(tree2), conflicts)
+}
+
+func TestClone(t *testing.T) {
+	tree := rbts.NewSummed[int, int]()
+	for i := range 50 {
+		rbts.Insert(tree, i, i)
+	}
+
+	clone := rbts.Clone(tree)
+	assert.Equal(t, rbts.Len(tree), rbts.Len(clone))
+	assert.Equal(t, rbts.RangeSum(tree, 0, 50), rbts.RangeSum(clone, 0, 50))
+
+	rbts.Insert(clone, 100, 100)
+	rbts.Delete(clone, 0)
+	rbts.Insert(clone, 1, -1)
+	assert.Equal(t, 50, rbts.Len(tree), "original should be untouched")
+	n, found := rbts.Search(tree, 1)
+	require.True(t, found)
+	assert.Equal(t, 1, n.Value())
+	_, found = rbts.Search(tree, 100)
+	assert.False(t, found)
+	assert.Equal(t, 49*50/2-2+100, rbts.RangeSum(clone, 0, 101))
+}
+
+func TestCloneSubtree(t *testing.T) {
+	assert.Zero(t, rbts.Len(rbts.CloneSubtree[int, string](nil)))
+
+	tree := rbts.New[int, string]()
+	for i := range 100 {
+		rbts.Insert(tree, i, fmt.Sprint(i))
+	}
+
+	for n := range rbts.InOrderNodes(tree) {
+		sub := rbts.CloneSubtree(n)
+		require.NoError(t, rbts.CheckInvariants(sub), "subtree at %d", n.Key())
+		lo, _ := rbts.Min(sub)
+		hi, _ := rbts.Max(sub)
+		assert.Equal(t, rbts.CountRange(tree, lo.Key(), hi.Key()+1), rbts.Len(sub),
+			"subtree at %d holds a contiguous run of keys", n.Key())
+		_, found := rbts.Search(sub, n.Key())
+		assert.True(t, found)
+	}
+
+	whole := rbts.CloneSubtree(tree.Root)
+	assert.True(t, rbts.Equal(tree, whole))
+	rbts.Insert(whole, 1000, "new")
+	rbts.Delete(whole, 0)
+	assert.Equal(t, 100, rbts.Len(tree), "the clone is independent")
+	_, found := rbts.Search(tree, 0)
+	assert.True(t, found)
+}
+
+func TestRebuild(t *testing.T) {
+	empty := rbts.New[int, string]()
+	rbts.Rebuild(empty)
+	assert.Zero(t, rbts.Len(empty))
+
+	for _, n := range []int{1, 2, 7, 8, 1000, 1023, 1024} {
+		tree := rbts.NewSummed[int, int]()
+		r := rand.New(rand.NewSource(int64(n)))
+		for _, k := range r.Perm(2 * n) {
+			rbts.Insert(tree, k, k)
+		}
+		for k := range n {
+			rbts.Delete(tree, 2*k+1)
+		}
+		before := slices.Collect(rbts.InOrder(tree))
+		held, _ := rbts.Search(tree, 0)
+
+		rbts.Rebuild(tree)
+		require.NoError(t, rbts.CheckInvariants(tree), "n=%d", n)
+		after := slices.Collect(rbts.InOrder(tree))
+		require.Len(t, after, n)
+		for i := range before {
+			assert.Equal(t, before[i].Key(), after[i].Key())
+			assert.Equal(t, before[i].Value(), after[i].Value())
+		}
+		assert.Equal(t, bits.Len(uint(n)), rbts.Stats(tree).Height, "n=%d: minimal height", n)
+		assert.Equal(t, n*(n-1), rbts.RangeSum(tree, 0, 2*n), "n=%d: sums are recomputed", n)
+		found, _ := rbts.Search(tree, 0)
+		assert.Same(t, held, found, "nodes are reused")
+	}
+}
+
+func TestSubtreeInOrder(t *testing.T) {
+	for range rbts.SubtreeInOrder[int, string](nil) {
+		t.Fatal("nil subtree should yield nothing")
+	}
+
+	tree := rbts.New[int, string]()
+	for _, v := range []int{4, 2, 6, 1, 3, 5, 7} {
+		rbts.Insert(tree, v, "")
+	}
+	keysUnder := func(key int) []int {
+		n, found := rbts.Search(tree, key)
+		require.True(t, found)
+		var keys []int
+		for n := range rbts.SubtreeInOrder(n) {
+			keys = append(keys, n.Key())
+		}
+		return keys
+	}
+	assert.Equal(t, []int{1, 2, 3}, keysUnder(2))
+	assert.Equal(t, []int{5, 6, 7}, keysUnder(6))
+	assert.Equal(t, []int{5}, keysUnder(5))
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, keysUnder(4))
+
+	big := rbts.New[int, string]()
+	for i := range 200 {
+		rbts.Insert(big, i, "")
+	}
+	for n := range rbts.InOrderNodes(big) {
+		var keys []int
+		for m := range rbts.SubtreeInOrder(n) {
+			keys = append(keys, m.Key())
+		}
+		require.True(t, slices.IsSorted(keys))
+		require.Contains(t, keys, n.Key())
+		require.Equal(t, rbts.Len(rbts.CloneSubtree(n)), len(keys))
+		require.Equal(t, rbts.CountRange(big, keys[0], keys[len(keys)-1]+1), len(keys))
+	}
+}
+
+func TestInOrderNodes(t *testing.T) {
+	tree := rbts.New[int, int]()
+	for i := range 20 {
+		rbts.Insert(tree, i, i)
+	}
+
+	for n := range rbts.InOrderNodes(tree) {
+		n.SetValue(n.Value() * 2)
+	}
+	for i := range 20 {
+		n, found := rbts.Search(tree, i)
+		require.True(t, found)
+		assert.Equal(t, i*2, n.Value())
+	}
+
+	count := 0
+	for range rbts.InOrderNodes(tree) {
+		count++
+		if count == 5 {
+			break
+		}
+	}
+	assert.Equal(t, 5, count)
+}
+
+func TestInOrderNoAlloc(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for range rbts.InOrderNoAlloc(tree) {
+		t.Fatal("empty tree should yield nothing")
+	}
+
+	r := rand.New(rand.NewSource(88))
+	for _, k := range r.Perm(200) {
+		rbts.Insert(tree, k, fmt.Sprint(k))
+	}
+	var want, got []int
+	for n := range rbts.InOrder(tree) {
+		want = append(want, n.Key())
+	}
+	for n := range rbts.InOrderNoAlloc(tree) {
+		assert.Equal(t, fmt.Sprint(n.Key()), n.Value())
+		got = append(got, n.Key())
+	}
+	assert.Equal(t, want, got)
+
+	got = nil
+	for n := range rbts.InOrderNoAlloc(tree) {
+		if n.Key() == 5 {
+			break
+		}
+		got = append(got, n.Key())
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, got)
+	assert.True(t, rbts.IsValid(tree), "breaking early leaves the tree intact")
+}
+
+func TestInOrderInto(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.Empty(t, rbts.InOrderInto(tree, nil))
+
+	for _, k := range rand.New(rand.NewSource(98)).Perm(100) {
+		rbts.Insert(tree, k, fmt.Sprint(k))
+	}
+	buf := rbts.InOrderInto(tree, nil)
+	require.Len(t, buf, 100)
+	for i, n := range buf {
+		assert.Equal(t, i, n.Key())
+		assert.Equal(t, fmt.Sprint(i), n.Value())
+	}
+
+	prefix := []rbts.Node[int, string]{buf[99]}
+	extended := rbts.InOrderInto(tree, prefix)
+	assert.Len(t, extended, 101, "nodes are appended after existing elements")
+	assert.Equal(t, 99, extended[0].Key())
+	assert.Equal(t, 0, extended[1].Key())
+
+	allocs := testing.AllocsPerRun(10, func() {
+		buf = rbts.InOrderInto(tree, buf[:0])
+	})
+	assert.Zero(t, allocs, "reusing the buffer should not allocate")
+}
+
+func TestCollect(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.Empty(t, rbts.Collect(tree, func(k int, v string) string { return v }))
+
+	for _, k := range []int{3, 1, 2} {
+		rbts.Insert(tree, k, strings.Repeat("x", k))
+	}
+	lines := rbts.Collect(tree, func(k int, v string) string { return fmt.Sprintf("%d=%s", k, v) })
+	assert.Equal(t, []string{"1=x", "2=xx", "3=xxx"}, lines)
+	assert.Len(t, lines, rbts.Len(tree))
+	assert.Equal(t, rbts.Len(tree), cap(lines))
+}
+
+func TestEnumerateInOrder(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for range rbts.EnumerateInOrder(tree) {
+		t.Fatal("empty tree should yield nothing")
+	}
+
+	r := rand.New(rand.NewSource(89))
+	for _, k := range r.Perm(100) {
+		rbts.Insert(tree, k*3, "")
+	}
+	next := 0
+	for i, n := range rbts.EnumerateInOrder(tree) {
+		require.Equal(t, next, i)
+		assert.Equal(t, i, rbts.Rank(tree, n.Key()))
+		next++
+	}
+	assert.Equal(t, rbts.Len(tree), next)
+
+	var indices []int
+	for i := range rbts.EnumerateInOrder(tree) {
+		if i == 3 {
+			break
+		}
+		indices = append(indices, i)
+	}
+	assert.Equal(t, []int{0, 1, 2}, indices)
+}
+
+func TestTakeDropWhile(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{1, 2, 3, 5, 6, 8} {
+		rbts.Insert(tree, v, "")
+	}
+	collect := func(seq func(func(rbts.Node[int, string]) bool)) []int {
+		keys := []int{}
+		for n := range seq {
+			keys = append(keys, n.Key())
+		}
+		return keys
+	}
+	below := func(limit int) func(int, string) bool {
+		return func(k int, _ string) bool { return k < limit }
+	}
+
+	assert.Empty(t, collect(rbts.TakeWhile(tree, below(0))), "fails at the start")
+	assert.Equal(t, []int{1, 2, 3, 5, 6, 8}, collect(rbts.DropWhile(tree, below(0))))
+
+	assert.Equal(t, []int{1, 2, 3}, collect(rbts.TakeWhile(tree, below(4))), "fails in the middle")
+	assert.Equal(t, []int{5, 6, 8}, collect(rbts.DropWhile(tree, below(4))))
+
+	assert.Equal(t, []int{1, 2, 3, 5, 6, 8}, collect(rbts.TakeWhile(tree, below(100))), "never fails")
+	assert.Empty(t, collect(rbts.DropWhile(tree, below(100))))
+
+	// DropWhile only skips the leading run, even if pred holds again later.
+	odd := func(k int, _ string) bool { return k%2 == 1 }
+	assert.Equal(t, []int{2, 3, 5, 6, 8}, collect(rbts.DropWhile(tree, odd)))
+
+	var first []int
+	for n := range rbts.DropWhile(tree, below(4)) {
+		first = append(first, n.Key())
+		break
+	}
+	assert.Equal(t, []int{5}, first)
+}
+
+func TestSetValue(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, "old")
+	}
+
+	n, found := rbts.Search(tree, 20)
+	require.True(t, found)
+	n.SetValue("new")
+
+	n, found = rbts.Search(tree, 20)
+	require.True(t, found)
+	assert.Equal(t, "new", n.Value())
+	assert.Equal(t, 3, rbts.Len(tree))
+	for _, v := range []int{10, 30} {
+		n, _ := rbts.Search(tree, v)
+		assert.Equal(t, "old", n.Value())
+	}
+
+	summed := rbts.NewSummed[int, int]()
+	rbts.Insert(summed, 1, 1)
+	sn, _ := rbts.Search(summed, 1)
+	assert.Panics(t, func() { sn.SetValue(2) })
+}
+
+func TestDeleteKeepsTreeValid(t *testing.T) {
+	// deleting every key from small trees reaches each fixup case, including
+	// removals whose doubly black position is a nil child
+	for size := 1; size <= 64; size++ {
+		for k := range size {
+			tree := rbts.New[int, string]()
+			for i := range size {
+				rbts.Insert(tree, i, "")
+			}
+			require.True(t, rbts.Delete(tree, k))
+			require.True(t, rbts.IsValid(tree), "size %d, deleted %d", size, k)
+			require.Equal(t, size-1, rbts.Len(tree))
+		}
+	}
+
+	r := rand.New(rand.NewSource(27))
+	tree := rbts.New[int, string]()
+	for range 5000 {
+		k := r.Intn(300)
+		if r.Intn(2) == 0 {
+			rbts.Insert(tree, k, "")
+		} else {
+			rbts.Delete(tree, k)
+		}
+		require.True(t, rbts.IsValid(tree))
+	}
+}
+
+func TestIsValid(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.True(t, rbts.IsValid(tree))
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+		assert.True(t, rbts.IsValid(tree))
+	}
+
+	first, _ := rbts.Kth(tree, 0)
+	detached := &rbts.Tree[int, string]{Root: first}
+	assert.False(t, rbts.IsValid(detached), "root with a parent link")
+}
+
+func TestNodeIdentityAcrossDeletes(t *testing.T) {
+	tree := rbts.New[int, string]()
+	r := rand.New(rand.NewSource(95))
+	held := map[int]*rbts.Node[int, string]{}
+	for _, k := range r.Perm(500) {
+		held[k], _ = rbts.InsertNode(tree, k, fmt.Sprint(k))
+	}
+
+	for i, k := range r.Perm(500)[:400] {
+		rbts.Delete(tree, k)
+		delete(held, k)
+		if i%20 != 0 {
+			continue
+		}
+		for key, n := range held {
+			require.Equal(t, key, n.Key(), "node for %d changed key", key)
+			require.Equal(t, fmt.Sprint(key), n.Value())
+			found, _ := rbts.Search(tree, key)
+			require.Same(t, n, found, "node for %d was replaced", key)
+		}
+	}
+	assert.Len(t, held, 100)
+
+	var evens []int
+	for k := range held {
+		if k%2 == 0 {
+			evens = append(evens, k)
+		}
+	}
+	rbts.DeleteAll(tree, evens)
+	for key, n := range held {
+		if key%2 != 0 {
+			found, _ := rbts.Search(tree, key)
+			assert.Same(t, n, found, "DeleteAll keeps surviving nodes")
+		}
+	}
+}
+
+func TestDeleteNode(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 100 {
+		rbts.Insert(tree, i, fmt.Sprint(i))
+	}
+
+	for i := 0; i < 100; i += 3 {
+		n, found := rbts.Search(tree, i)
+		require.True(t, found)
+		rbts.DeleteNode(tree, n)
+		require.True(t, rbts.IsValid(tree))
+		_, found = rbts.Search(tree, i)
+		assert.False(t, found)
+	}
+	assert.Equal(t, 66, rbts.Len(tree))
+
+	kept, _ := rbts.Search(tree, 50)
+	first, _ := rbts.Min(tree)
+	rbts.DeleteNode(tree, first)
+	assert.Equal(t, "50", kept.Value(), "other nodes stay valid")
+	assert.Equal(t, 50, kept.Key())
+
+	rbts.DeleteNode(tree, nil)
+	assert.Equal(t, 65, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+}
+
+func TestRandomOperationsProperty(t *testing.T) {
+	for seed := range int64(8) {
+		r := rand.New(rand.NewSource(seed))
+		tree := rbts.NewSummed[int, int]()
+		ref := map[int]int{}
+		for op := range 4000 {
+			k := r.Intn(500)
+			if r.Intn(5) < 3 {
+				v := r.Intn(1000)
+				rbts.Insert(tree, k, v)
+				ref[k] = v
+			} else {
+				_, present := ref[k]
+				require.Equal(t, present, rbts.Delete(tree, k))
+				delete(ref, k)
+			}
+
+			require.True(t, rbts.IsValid(tree), "seed %d, op %d", seed, op)
+			require.Equal(t, len(ref), rbts.Len(tree))
+			if op%100 == 0 {
+				sum, i := 0, 0
+				for n := range rbts.InOrder(tree) {
+					require.Equal(t, ref[n.Key()], n.Value())
+					require.Equal(t, i, rbts.Rank(tree, n.Key()))
+					sum += n.Value()
+					i++
+				}
+				require.Equal(t, sum, rbts.RangeSum(tree, 0, 500))
+			}
+		}
+	}
+}
+
+func TestRandomMultiOperationsProperty(t *testing.T) {
+	r := rand.New(rand.NewSource(29))
+	tree := rbts.NewMulti[int, int]()
+	ref := map[int]int{}
+	for op := range 4000 {
+		k := r.Intn(50)
+		if r.Intn(2) == 0 {
+			rbts.Insert(tree, k, op)
+			ref[k]++
+		} else {
+			require.Equal(t, ref[k] > 0, rbts.Delete(tree, k))
+			ref[k] = max(ref[k]-1, 0)
+		}
+		require.True(t, rbts.IsValid(tree), "op %d", op)
+		require.Equal(t, ref[k], rbts.Count(tree, k))
+	}
+}
+
+func TestMergeIter(t *testing.T) {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	c := rbts.New[int, string]()
+	for i := 0; i < 30; i += 2 {
+		rbts.Insert(a, i, "a")
+	}
+	for i := 0; i < 30; i += 3 {
+		rbts.Insert(b, i, "b")
+	}
+	for i := 0; i < 30; i += 5 {
+		rbts.Insert(c, i, "c")
+	}
+
+	var keys []int
+	for k, v := range rbts.MergeIter(a, b, c) {
+		switch {
+		case k%2 == 0:
+			assert.Equal(t, "a", v, "key %d", k)
+		case k%3 == 0:
+			assert.Equal(t, "b", v, "key %d", k)
+		default:
+			assert.Equal(t, "c", v, "key %d", k)
+		}
+		keys = append(keys, k)
+	}
+	var want []int
+	for i := range 30 {
+		if i%2 == 0 || i%3 == 0 || i%5 == 0 {
+			want = append(want, i)
+		}
+	}
+	assert.Equal(t, want, keys)
+
+	keys = nil
+	for k, v := range rbts.MergeIter(c, b, a) {
+		if k%5 == 0 {
+			assert.Equal(t, "c", v, "earliest tree wins for key %d", k)
+		}
+		keys = append(keys, k)
+		if len(keys) == 4 {
+			break
+		}
+	}
+	assert.Equal(t, []int{0, 2, 3, 4}, keys)
+
+	for range rbts.MergeIter[int, string]() {
+		t.Fatal("merging no trees should yield nothing")
+	}
+	for range rbts.MergeIter(rbts.New[int, string](), rbts.New[int, string]()) {
+		t.Fatal("merging empty trees should yield nothing")
+	}
+}
+
+func TestMergeIterFunc(t *testing.T) {
+	a := rbts.New[int, int]()
+	b := rbts.New[int, int]()
+	for i := 0; i < 30; i += 2 {
+		rbts.Insert(a, i, 1)
+	}
+	for i := 0; i < 30; i += 3 {
+		rbts.Insert(b, i, 10)
+	}
+	sum := func(av, bv int) int { return av + bv }
+
+	var keys []int
+	for k, v := range rbts.MergeIterFunc(a, b, sum) {
+		switch {
+		case k%6 == 0:
+			assert.Equal(t, 11, v, "key %d is resolved", k)
+		case k%2 == 0:
+			assert.Equal(t, 1, v, "key %d", k)
+		default:
+			assert.Equal(t, 10, v, "key %d", k)
+		}
+		keys = append(keys, k)
+	}
+	var want []int
+	for i := range 30 {
+		if i%2 == 0 || i%3 == 0 {
+			want = append(want, i)
+		}
+	}
+	assert.Equal(t, want, keys)
+
+	keys = nil
+	for k := range rbts.MergeIterFunc(a, b, sum) {
+		keys = append(keys, k)
+		if len(keys) == 3 {
+			break
+		}
+	}
+	assert.Equal(t, []int{0, 2, 3}, keys)
+
+	multi := rbts.NewMulti[int, int]()
+	rbts.Insert(multi, 1, 100)
+	rbts.Insert(multi, 1, 200)
+	rbts.Insert(multi, 3, 300)
+	var got [][2]int
+	for k, v := range rbts.MergeIterFunc(multi, a, sum) {
+		got = append(got, [2]int{k, v})
+		if k >= 4 {
+			break
+		}
+	}
+	assert.Equal(t, [][2]int{{0, 1}, {1, 100}, {2, 1}, {3, 300}, {4, 1}}, got)
+
+	for range rbts.MergeIterFunc(rbts.New[int, int](), rbts.New[int, int](), sum) {
+		t.Fatal("merging empty trees should yield nothing")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	assert.True(t, rbts.Equal(a, b))
+
+	for i := range 50 {
+		rbts.Insert(a, i, fmt.Sprint(i))
+	}
+	for i := 49; i >= 0; i-- {
+		rbts.Insert(b, i, fmt.Sprint(i))
+	}
+	assert.True(t, rbts.Equal(a, b), "insertion order and shape do not matter")
+
+	rbts.Insert(b, 10, "changed")
+	assert.False(t, rbts.Equal(a, b))
+	rbts.Insert(b, 10, "10")
+	rbts.Delete(b, 20)
+	assert.False(t, rbts.Equal(a, b))
+	rbts.Insert(b, 100, "20")
+	assert.False(t, rbts.Equal(a, b), "same size but different keys")
+}
+
+func TestEqualFunc(t *testing.T) {
+	approx := func(x, y float64) bool { return math.Abs(x-y) < 1e-9 }
+	tenth, fifth := 0.1, 0.2
+	a := rbts.New[string, float64]()
+	b := rbts.New[string, float64]()
+	rbts.Insert(a, "p50", tenth+fifth)
+	rbts.Insert(b, "p50", 0.3)
+	rbts.Insert(a, "p99", 1.5)
+	rbts.Insert(b, "p99", 1.5)
+	assert.False(t, rbts.Equal(a, b))
+	assert.True(t, rbts.EqualFunc(a, b, approx))
+
+	rbts.Insert(b, "p99", 1.6)
+	assert.False(t, rbts.EqualFunc(a, b, approx))
+
+	sa := rbts.New[int, []int]()
+	sb := rbts.New[int, []int]()
+	rbts.Insert(sa, 1, []int{1, 2})
+	rbts.Insert(sb, 1, []int{1, 2})
+	assert.True(t, rbts.EqualFunc(sa, sb, slices.Equal[[]int]))
+}
+
+func TestEqualKeys(t *testing.T) {
+	a := rbts.New[int, []byte]()
+	b := rbts.New[int, []byte]()
+	assert.True(t, rbts.EqualKeys(a, b))
+
+	for i := range 20 {
+		rbts.Insert(a, i, []byte("blob"))
+		rbts.Insert(b, 19-i, []byte{byte(i)})
+	}
+	assert.True(t, rbts.EqualKeys(a, b), "values are ignored")
+
+	rbts.Delete(b, 7)
+	assert.False(t, rbts.EqualKeys(a, b))
+	rbts.Insert(b, 70, nil)
+	assert.False(t, rbts.EqualKeys(a, b), "same size, different keys")
+}
+
+func TestCompare(t *testing.T) {
+	build := func(pairs ...string) *rbts.Tree[int, string] {
+		tree := rbts.New[int, string]()
+		for i, v := range pairs {
+			rbts.Insert(tree, i, v)
+		}
+		return tree
+	}
+
+	assert.Zero(t, rbts.Compare(build(), build()))
+	assert.Zero(t, rbts.Compare(build("a", "b"), build("a", "b")))
+
+	assert.Equal(t, -1, rbts.Compare(build("a"), build("a", "b")), "shorter prefix sorts first")
+	assert.Equal(t, +1, rbts.Compare(build("a", "b"), build("a")))
+	assert.Equal(t, -1, rbts.Compare(build(), build("a")))
+
+	assert.Equal(t, -1, rbts.Compare(build("a", "b"), build("a", "c")), "differ in a value")
+	assert.Equal(t, +1, rbts.Compare(build("a", "c"), build("a", "b")))
+
+	a := build("a", "b")
+	b := build("a")
+	rbts.Insert(b, 5, "b")
+	assert.Equal(t, -1, rbts.Compare(a, b), "differ in a key")
+	assert.Equal(t, +1, rbts.Compare(b, a))
+}
+
+func TestDiff(t *testing.T) {
+	prev := rbts.New[int, string]()
+	next := rbts.New[int, string]()
+	for _, v := range []int{1, 2, 3, 4, 5} {
+		rbts.Insert(prev, v, "v")
+		rbts.Insert(next, v, "v")
+	}
+
+	added, removed, changed := rbts.Diff(prev, next)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+	assert.Empty(t, changed)
+
+	rbts.Delete(next, 1)
+	rbts.Delete(next, 4)
+	rbts.Insert(next, 0, "v")
+	rbts.Insert(next, 6, "v")
+	rbts.Insert(next, 3, "changed")
+
+	added, removed, changed = rbts.Diff(prev, next)
+	assert.Equal(t, []int{0, 6}, added)
+	assert.Equal(t, []int{1, 4}, removed)
+	assert.Equal(t, []int{3}, changed)
+
+	added, removed, changed = rbts.Diff(rbts.New[int, string](), next)
+	assert.Equal(t, []int{0, 2, 3, 5, 6}, added)
+	assert.Empty(t, removed)
+	assert.Empty(t, changed)
+}
+
+func TestDiffFunc(t *testing.T) {
+	prev := rbts.New[int, []int]()
+	next := rbts.New[int, []int]()
+	rbts.Insert(prev, 1, []int{1})
+	rbts.Insert(prev, 2, []int{2})
+	rbts.Insert(prev, 3, []int{3})
+	rbts.Insert(next, 2, []int{2})
+	rbts.Insert(next, 3, []int{3, 3})
+	rbts.Insert(next, 4, []int{4})
+
+	added, removed, changed := rbts.DiffFunc(prev, next, slices.Equal[[]int])
+	assert.Equal(t, []int{4}, added)
+	assert.Equal(t, []int{1}, removed)
+	assert.Equal(t, []int{3}, changed)
+}
+
+func TestPatch(t *testing.T) {
+	r := rand.New(rand.NewSource(32))
+	replica := rbts.New[int, int]()
+	target := rbts.New[int, int]()
+	for range 300 {
+		k, v := r.Intn(200), r.Intn(5)
+		rbts.Insert(replica, k, v)
+		rbts.Insert(target, k, v)
+	}
+	for range 200 {
+		k := r.Intn(250)
+		if r.Intn(2) == 0 {
+			rbts.Delete(target, k)
+		} else {
+			rbts.Insert(target, k, r.Intn(5))
+		}
+	}
+
+	addedKeys, removed, changedKeys := rbts.Diff(replica, target)
+	require.NotEmpty(t, addedKeys)
+	require.NotEmpty(t, removed)
+	require.NotEmpty(t, changedKeys)
+	added, changed := map[int]int{}, map[int]int{}
+	for _, k := range addedKeys {
+		n, _ := rbts.Search(target, k)
+		added[k] = n.Value()
+	}
+	for _, k := range changedKeys {
+		n, _ := rbts.Search(target, k)
+		changed[k] = n.Value()
+	}
+
+	rbts.Patch(replica, added, removed, changed)
+	assert.True(t, rbts.IsValid(replica))
+	assert.Equal(t, rbts.Len(target), rbts.Len(replica))
+	var want, got [][2]int
+	for n := range rbts.InOrder(target) {
+		want = append(want, [2]int{n.Key(), n.Value()})
+	}
+	for n := range rbts.InOrder(replica) {
+		got = append(got, [2]int{n.Key(), n.Value()})
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestMarshalBinary(t *testing.T) {
+	r := rand.New(rand.NewSource(106))
+	tree := rbts.New[int, string]()
+	for range 500 {
+		k := r.Intn(2000) - 1000
+		rbts.Insert(tree, k, strings.Repeat("v", r.Intn(5)))
+	}
+	data, err := tree.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := rbts.New[int, string]()
+	rbts.Insert(decoded, 5000, "replaced")
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.True(t, rbts.IsValid(decoded))
+	assert.True(t, rbts.Equal(tree, decoded))
+
+	var empty rbts.Tree[int, string]
+	data, err = empty.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Zero(t, rbts.Len(decoded))
+}
+
+func TestMarshalBinaryValueTypes(t *testing.T) {
+	times := rbts.New[float64, time.Time]()
+	base := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	for i := range 10 {
+		rbts.Insert(times, float64(i)/4, base.Add(time.Duration(i)*time.Hour))
+	}
+	data, err := times.MarshalBinary()
+	require.NoError(t, err)
+	decoded := rbts.New[float64, time.Time]()
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.True(t, rbts.EqualFunc(times, decoded, time.Time.Equal))
+
+	ptrs := rbts.New[string, *time.Time]()
+	rbts.Insert(ptrs, "a", &base)
+	data, err = ptrs.MarshalBinary()
+	require.NoError(t, err)
+	decodedPtrs := rbts.New[string, *time.Time]()
+	require.NoError(t, decodedPtrs.UnmarshalBinary(data))
+	n, ok := rbts.Search(decodedPtrs, "a")
+	require.True(t, ok)
+	assert.True(t, base.Equal(*n.Value()))
+
+	rbts.Insert(ptrs, "nil", nil)
+	data, err = ptrs.MarshalBinary()
+	require.NoError(t, err, "nil pointer values are encoded")
+	require.NoError(t, decodedPtrs.UnmarshalBinary(data))
+	n, ok = rbts.Search(decodedPtrs, "nil")
+	require.True(t, ok)
+	assert.Nil(t, n.Value())
+	n, ok = rbts.Search(decodedPtrs, "a")
+	require.True(t, ok)
+	assert.True(t, base.Equal(*n.Value()))
+
+	type marshaler interface{ MarshalBinary() ([]byte, error) }
+	boxed := rbts.New[int, marshaler]()
+	var nilTime *time.Time
+	rbts.Insert[int, marshaler](boxed, 1, nilTime)
+	_, err = boxed.MarshalBinary()
+	assert.Error(t, err, "a nil pointer in an interface is an error, not a panic")
+
+	type point struct{ X, Y int }
+	structs := rbts.New[int, point]()
+	rbts.Insert(structs, 1, point{})
+	_, err = structs.MarshalBinary()
+	assert.Error(t, err)
+}
+
+func TestMarshalBinaryMulti(t *testing.T) {
+	multi := rbts.NewMulti[int, int]()
+	for i := range 6 {
+		rbts.Insert(multi, i%2, i)
+	}
+	data, err := multi.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := rbts.NewMulti[int, int]()
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	assert.True(t, rbts.Equal(multi, decoded))
+
+	plain := rbts.New[int, int]()
+	rbts.Insert(plain, 7, 7)
+	assert.Error(t, plain.UnmarshalBinary(data))
+	assert.Equal(t, 1, rbts.Len(plain), "a failed decode leaves the tree unchanged")
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	tree := rbts.New[int8, string]()
+	rbts.Insert(tree, 1, "one")
+	rbts.Insert(tree, 2, "two")
+	data, err := tree.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := rbts.New[int8, string]()
+	assert.Error(t, decoded.UnmarshalBinary(nil))
+	assert.Error(t, decoded.UnmarshalBinary(append([]byte{99}, data[1:]...)), "unknown version")
+	for i := 1; i < len(data); i++ {
+		assert.Error(t, decoded.UnmarshalBinary(data[:i]), "truncated at %d", i)
+	}
+	assert.Error(t, decoded.UnmarshalBinary(append(slices.Clone(data), 0)), "trailing byte")
+
+	nan := rbts.New[float64, int]()
+	rbts.Insert(nan, math.NaN(), 0)
+	data, err = nan.MarshalBinary()
+	require.NoError(t, err)
+	decodedNaN := rbts.New[float64, int]()
+	assert.Error(t, decodedNaN.UnmarshalBinary(data), "NaN keys are rejected")
+	assert.Zero(t, rbts.Len(decodedNaN))
+
+	wide := rbts.New[int, string]()
+	rbts.Insert(wide, 1000, "too big for int8")
+	data, err = wide.MarshalBinary()
+	require.NoError(t, err)
+	assert.Error(t, decoded.UnmarshalBinary(data))
+	assert.Zero(t, rbts.Len(decoded))
+}
+
+func TestApproxBytes(t *testing.T) {
+	tree := rbts.New[int, string]()
+	empty := rbts.ApproxBytes(tree)
+	assert.Positive(t, empty)
+
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+	}
+	hundred := rbts.ApproxBytes(tree)
+	for i := 100; i < 200; i++ {
+		rbts.Insert(tree, i, "")
+	}
+	twoHundred := rbts.ApproxBytes(tree)
+
+	perNode := (hundred - empty) / 100
+	assert.Positive(t, perNode)
+	assert.Equal(t, empty+100*perNode, hundred)
+	assert.Equal(t, empty+200*perNode, twoHundred, "estimate should grow linearly")
+}
+
+func TestUpdate(t *testing.T) {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+
+	assert.True(t, rbts.Update(tree, 10, "TEN"))
+	n, _ := rbts.Search(tree, 10)
+	assert.Equal(t, "TEN", n.Value())
+
+	assert.False(t, rbts.Update(tree, 20, "twenty"))
+	_, found := rbts.Search(tree, 20)
+	assert.False(t, found, "Update must not insert")
+	assert.Equal(t, 1, rbts.Len(tree))
+
+	summed := rbts.NewSummed[int, int]()
+	for i := range 10 {
+		rbts.Insert(summed, i, 1)
+	}
+	rbts.Update(summed, 3, 100)
+	assert.Equal(t, 109, rbts.RangeSum(summed, 0, 10))
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	tree := rbts.NewSummed[string, int]()
+	rbts.Insert(tree, "a", 1)
+	rbts.Insert(tree, "b", 2)
+
+	assert.False(t, rbts.CompareAndSwap(tree, "missing", 0, 5), "absent key")
+	_, found := rbts.Search(tree, "missing")
+	assert.False(t, found, "CompareAndSwap never inserts")
+
+	assert.False(t, rbts.CompareAndSwap(tree, "a", 7, 5), "value mismatch")
+	n, _ := rbts.Search(tree, "a")
+	assert.Equal(t, 1, n.Value())
+
+	assert.True(t, rbts.CompareAndSwap(tree, "a", 1, 5))
+	assert.Equal(t, 5, n.Value())
+	assert.Equal(t, 7, rbts.RangeSum(tree, "a", "z"), "augmented data is updated")
+	assert.False(t, rbts.CompareAndSwap(tree, "a", 1, 9), "stale expected value")
+}
+
+func TestDeleteAll(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for i := range 50 {
+		rbts.Insert(tree, i, "")
+	}
+
+	removed := rbts.DeleteAll(tree, []int{5, 10, 10, 99, 15, -1, 5})
+	assert.Equal(t, 3, removed, "absent keys and repeats are not counted")
+	assert.Equal(t, 47, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+	for _, k := range []int{5, 10, 15} {
+		_, found := rbts.Search(tree, k)
+		assert.False(t, found)
+	}
+
+	assert.Equal(t, 0, rbts.DeleteAll(tree, nil))
+}
+
+func TestDeleteAllLargeBatch(t *testing.T) {
+	r := rand.New(rand.NewSource(41))
+	tree := rbts.New[int, string]()
+	ref := map[int]bool{}
+	for range 1000 {
+		k := r.Intn(2000)
+		rbts.Insert(tree, k, "")
+		ref[k] = true
+	}
+	kept, _ := rbts.Max(tree)
+
+	keys := make([]int, 800)
+	expected := 0
+	for i := range keys {
+		keys[i] = r.Intn(2000)
+		if keys[i] == kept.Key() {
+			keys[i]++
+		}
+		if ref[keys[i]] {
+			expected++
+			delete(ref, keys[i])
+		}
+	}
+	original := slices.Clone(keys)
+
+	assert.Equal(t, expected, rbts.DeleteAll(tree, keys))
+	assert.Equal(t, original, keys, "the caller's slice is not reordered")
+	assert.Equal(t, len(ref), rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+	for n := range rbts.InOrder(tree) {
+		assert.True(t, ref[n.Key()])
+	}
+	n, found := rbts.Search(tree, kept.Key())
+	require.True(t, found)
+	assert.Same(t, kept, n, "surviving nodes are reused")
+
+	multi := rbts.NewMulti[int, string]()
+	for _, k := range []int{1, 1, 1, 2, 3, 3} {
+		rbts.Insert(multi, k, "")
+	}
+	assert.Equal(t, 4, rbts.DeleteAll(multi, []int{3, 1, 1, 3, 3, 4}))
+	assert.Equal(t, 1, rbts.Count(multi, 1))
+	assert.Equal(t, 1, rbts.Count(multi, 2))
+	assert.Equal(t, 0, rbts.Count(multi, 3))
+	assert.True(t, rbts.IsValid(multi))
+}
+
+func TestUpsert(t *testing.T) {
+	tree := rbts.NewSummed[string, int]()
+	increment := func(old int, existed bool) int {
+		if !existed {
+			assert.Zero(t, old)
+			return 1
+		}
+		return old + 1
+	}
+
+	for _, k := range []string{"a", "b", "a", "c", "a", "b"} {
+		rbts.Upsert(tree, k, increment)
+	}
+	assert.Equal(t, 3, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+	for k, want := range map[string]int{"a": 3, "b": 2, "c": 1} {
+		n, found := rbts.Search(tree, k)
+		require.True(t, found)
+		assert.Equal(t, want, n.Value())
+	}
+	assert.Equal(t, 6, rbts.RangeSum(tree, "a", "z"))
+}
+
+func TestUpsertCallbackSeesConsistentTree(t *testing.T) {
+	tree := rbts.New[int, int]()
+	for i := range 5 {
+		rbts.Insert(tree, i*2, 0)
+	}
+	rbts.Upsert(tree, 4, func(int, bool) int { return rbts.Len(tree) })
+	n, _ := rbts.Search(tree, 4)
+	assert.Equal(t, 5, n.Value(), "f sees the tree before the update")
+	rbts.Upsert(tree, 5, func(int, bool) int { return rbts.Len(tree) })
+	n, _ = rbts.Search(tree, 5)
+	assert.Equal(t, 5, n.Value(), "f sees the tree before the insertion")
+	assert.True(t, rbts.IsValid(tree))
+
+	for _, key := range []int{4, 7} {
+		assert.Panics(t, func() {
+			rbts.Upsert(tree, key, func(int, bool) int { panic("boom") })
+		})
+		assert.Equal(t, 6, rbts.Len(tree), "a panic in f leaves the tree unchanged")
+		assert.True(t, rbts.IsValid(tree))
+	}
+}
+
+func TestUpsertMulti(t *testing.T) {
+	tree := rbts.NewMulti[int, int]()
+	for i := range 3 {
+		rbts.Insert(tree, 1, i)
+	}
+	rbts.Insert(tree, 0, 0)
+	rbts.Insert(tree, 2, 0)
+	rbts.Upsert(tree, 1, func(old int, existed bool) int {
+		assert.True(t, existed)
+		assert.Zero(t, old, "the earliest duplicate is passed to f")
+		return 100
+	})
+	var got []int
+	for n := range rbts.InOrder(tree) {
+		if n.Key() == 1 {
+			got = append(got, n.Value())
+		}
+	}
+	assert.Equal(t, []int{100, 1, 2}, got)
+	assert.Equal(t, 5, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+}
+
+func TestEntry(t *testing.T) {
+	tree := rbts.NewSummed[string, int]()
+	for _, k := range []string{"a", "b", "a", "c", "a", "b"} {
+		rbts.Entry(tree, k).AndModify(func(v *int) { *v++ }).OrInsert(1)
+	}
+	assert.Equal(t, 3, rbts.Len(tree))
+	assert.True(t, rbts.IsValid(tree))
+	for k, want := range map[string]int{"a": 3, "b": 2, "c": 1} {
+		v, found := rbts.Entry(tree, k).Value()
+		require.True(t, found)
+		assert.Equal(t, want, v)
+	}
+	assert.Equal(t, 6, rbts.RangeSum(tree, "a", "z"))
+
+	e := rbts.Entry(tree, "d")
+	_, found := e.Value()
+	assert.False(t, found)
+	assert.Equal(t, 10, e.OrInsert(10))
+	e.AndModify(func(v *int) { *v *= 2 })
+	assert.Equal(t, 20, e.OrInsert(99), "OrInsert keeps an existing value")
+	v, found := e.Value()
+	require.True(t, found)
+	assert.Equal(t, 20, v)
+	assert.Equal(t, 26, rbts.RangeSum(tree, "a", "z"))
+
+	large := rbts.New[int, int]()
+	for i := range 1000 {
+		rbts.Entry(large, i*7%1000).OrInsert(i)
+		require.True(t, rbts.IsValid(large))
+	}
+	assert.Equal(t, 1000, rbts.Len(large))
+}
+
+func TestSuccessorOf(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, fmt.Sprint(v))
+	}
+
+	k, v, ok := rbts.SuccessorOf(tree, 20)
+	require.True(t, ok, "present key")
+	assert.Equal(t, 30, k)
+	assert.Equal(t, "30", v)
+
+	k, _, ok = rbts.SuccessorOf(tree, 15)
+	require.True(t, ok, "absent key")
+	assert.Equal(t, 20, k)
+
+	_, _, ok = rbts.SuccessorOf(tree, 30)
+	assert.False(t, ok)
+}
+
+func TestPredecessorOf(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, fmt.Sprint(v))
+	}
+
+	k, v, ok := rbts.PredecessorOf(tree, 20)
+	require.True(t, ok, "present key")
+	assert.Equal(t, 10, k)
+	assert.Equal(t, "10", v)
+
+	k, _, ok = rbts.PredecessorOf(tree, 25)
+	require.True(t, ok, "absent key")
+	assert.Equal(t, 20, k)
+
+	_, _, ok = rbts.PredecessorOf(tree, 10)
+	assert.False(t, ok)
+}
+
+func TestValueOr(t *testing.T) {
+	tree := rbts.New[string, int]()
+	assert.Equal(t, 8080, rbts.ValueOr(tree, "port", 8080))
+
+	rbts.Insert(tree, "port", 9090)
+	rbts.Insert(tree, "retries", 0)
+	assert.Equal(t, 9090, rbts.ValueOr(tree, "port", 8080))
+	assert.Equal(t, 0, rbts.ValueOr(tree, "retries", 3), "a stored zero value is returned")
+	assert.Equal(t, 30, rbts.ValueOr(tree, "timeout", 30))
+}
+
+func TestGetRef(t *testing.T) {
+	type stats struct {
+		hits  int
+		bytes [64]byte
+	}
+	tree := rbts.New[string, stats]()
+	rbts.Insert(tree, "a", stats{})
+	rbts.Insert(tree, "b", stats{})
+
+	ref, ok := rbts.GetRef(tree, "a")
+	require.True(t, ok)
+	ref.hits += 5
+	ref.bytes[0] = 1
+
+	n, _ := rbts.Search(tree, "a")
+	assert.Equal(t, 5, n.Value().hits)
+	assert.Equal(t, byte(1), n.Value().bytes[0])
+
+	rbts.Delete(tree, "b")
+	ref.hits++
+	n, _ = rbts.Search(tree, "a")
+	assert.Equal(t, 6, n.Value().hits, "deleting another key keeps the reference valid")
+
+	ref, ok = rbts.GetRef(tree, "z")
+	assert.False(t, ok)
+	assert.Nil(t, ref)
+}
+
+func TestValueOf(t *testing.T) {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+
+	n, _ := rbts.Search(tree, 10)
+	v, ok := rbts.ValueOf(n)
+	assert.True(t, ok)
+	assert.Equal(t, "ten", v)
+
+	n, _ = rbts.Search(tree, 20)
+	v, ok = rbts.ValueOf(n)
+	assert.False(t, ok)
+	assert.Equal(t, "", v)
+}
+
+func TestFromRank(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	tree := rbts.New[int, string]()
+	for range 60 {
+		rbts.Insert(tree, r.Intn(500), "")
+	}
+	sorted := []int{}
+	for n := range rbts.InOrder(tree) {
+		sorted = append(sorted, n.Key())
+	}
+
+	for _, k := range []int{-3, 0, 1, 25, len(sorted) - 1, len(sorted), len(sorted) + 10} {
+		keys := []int{}
+		for n := range rbts.FromRank(tree, k) {
+			keys = append(keys, n.Key())
+		}
+		assert.Equal(t, sorted[min(max(k, 0), len(sorted)):], keys, "k=%d", k)
+	}
+
+	count := 0
+	for range rbts.FromRank(tree, 10) {
+		count++
+		if count == 3 {
+			break
+		}
+	}
+	assert.Equal(t, 3, count)
+}
+
+func TestFromDescending(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for range rbts.FromDescending(tree, 10) {
+		t.Fatal("empty tree should yield nothing")
+	}
+	for _, v := range []int{10, 20, 30, 40, 50} {
+		rbts.Insert(tree, v, "")
+	}
+	collect := func(start, limit int) []int {
+		keys := []int{}
+		for n := range rbts.FromDescending(tree, start) {
+			if len(keys) == limit {
+				break
+			}
+			keys = append(keys, n.Key())
+		}
+		return keys
+	}
+
+	assert.Equal(t, []int{30, 20, 10}, collect(30, 10), "present anchor")
+	assert.Equal(t, []int{30, 20, 10}, collect(35, 10), "absent anchor")
+	assert.Equal(t, []int{50, 40}, collect(100, 2), "early break")
+	assert.Empty(t, collect(5, 10), "anchor below every key")
+
+	multi := rbts.NewMulti[int, string]()
+	for _, v := range []string{"a", "b", "c"} {
+		rbts.Insert(multi, 1, v)
+	}
+	rbts.Insert(multi, 0, "z")
+	var values []string
+	for n := range rbts.FromDescending(multi, 1) {
+		values = append(values, n.Value())
+	}
+	assert.Equal(t, []string{"c", "b", "a", "z"}, values)
+}
+
+func TestClearAndZero(t *testing.T) {
+	tree := rbts.New[int, []byte]()
+	for i := range 100 {
+		rbts.Insert(tree, i, make([]byte, 1024))
+	}
+	held, found := rbts.Search(tree, 42)
+	require.True(t, found)
+	next, _ := rbts.Successor(held)
+
+	rbts.ClearAndZero(tree)
+	assert.Nil(t, tree.Root)
+	assert.Equal(t, 0, rbts.Len(tree))
+	assert.Nil(t, held.Value(), "held node's value should be zeroed")
+	assert.Nil(t, next.Value())
+	_, ok := rbts.Successor(held)
+	assert.False(t, ok, "held node should be unlinked")
+
+	rbts.Insert(tree, 1, nil)
+	assert.Equal(t, 1, rbts.Len(tree))
+}
+
+func TestWalk(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{4, 2, 6, 1, 3, 5, 7} {
+		rbts.Insert(tree, v, "")
+	}
+
+	walk := func(order rbts.Order, limit int) []int {
+		var keys []int
+		rbts.Walk(tree, order, rbts.VisitorFunc[int, string](func(n *rbts.Node[int, string]) bool {
+			keys = append(keys, n.Key())
+			return len(keys) < limit
+		}))
+		return keys
+	}
+
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, walk(rbts.Ascending, 100))
+	assert.Equal(t, []int{7, 6, 5, 4, 3, 2, 1}, walk(rbts.Descending, 100))
+	assert.Equal(t, []int{4, 2, 1, 3, 6, 5, 7}, walk(rbts.PreOrder, 100))
+	assert.Equal(t, []int{1, 3, 2, 5, 7, 6, 4}, walk(rbts.PostOrder, 100))
+
+	assert.Equal(t, []int{1, 2, 3}, walk(rbts.Ascending, 3), "returning false stops the walk")
+	assert.Equal(t, []int{7, 6}, walk(rbts.Descending, 2))
+	assert.Equal(t, []int{4, 2, 1, 3}, walk(rbts.PreOrder, 4))
+	assert.Equal(t, []int{1, 3, 2, 5}, walk(rbts.PostOrder, 4))
+
+	assert.Panics(t, func() { walk(rbts.Order(99), 1) })
+}
+
+func TestWalkEuler(t *testing.T) {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{4, 2, 6, 1, 3, 5, 7} {
+		rbts.Insert(tree, v, "")
+	}
+
+	// tour records every callback and returns false at the phase and key given
+	// by stop, if any.
+	tour := func(stop string) string {
+		var events []string
+		visit := func(phase string) func(*rbts.Node[int, string]) bool {
+			return func(n *rbts.Node[int, string]) bool {
+				event := fmt.Sprint(phase, n.Key())
+				events = append(events, event)
+				return event != stop
+			}
+		}
+		rbts.WalkEuler(tree, rbts.EulerVisitor[int, string]{Pre: visit("pre"), In: visit("in"), Post: visit("post")})
+		return strings.Join(events, " ")
+	}
+
+	assert.Equal(t,
+		"pre4 pre2 pre1 in1 post1 in2 pre3 in3 post3 post2 in4 pre6 pre5 in5 post5 in6 pre7 in7 post7 post6 post4",
+		tour(""))
+	assert.Equal(t,
+		"pre4 pre2 in4 pre6 pre5 in5 post5 in6 pre7 in7 post7 post6 post4",
+		tour("pre2"), "Pre returning false skips the subtree, In, and Post")
+	assert.Equal(t,
+		"pre4 pre2 pre1 in1 post1 in2 post2 in4 pre6 pre5 in5 post5 in6 pre7 in7 post7 post6 post4",
+		tour("in2"), "In returning false skips the right subtree")
+	assert.Equal(t,
+		"pre4 pre2 pre1 in1 post1 in2 pre3 in3 post3",
+		tour("post3"), "Post returning false stops the walk")
+
+	var inOrder []int
+	rbts.WalkEuler(tree, rbts.EulerVisitor[int, string]{In: func(n *rbts.Node[int, string]) bool {
+		inOrder = append(inOrder, n.Key())
+		return true
+	}})
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7}, inOrder, "nil callbacks are skipped")
+
+	rbts.WalkEuler(rbts.New[int, string](), rbts.EulerVisitor[int, string]{})
+}
+
+func TestCheckInvariants(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.NoError(t, rbts.CheckInvariants(tree))
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+	}
+	assert.NoError(t, rbts.CheckInvariants(tree))
+
+	first, _ := rbts.Kth(tree, 0)
+	detached := &rbts.Tree[int, string]{Root: first}
+	assert.EqualError(t, rbts.CheckInvariants(detached), "redblacktrees: root has a parent")
+}
+
+func FuzzInsertDelete(f *testing.F) {
+	f.Add([]byte{1, 2, 3, 0x41, 0x42, 0x43})
+	f.Add([]byte{10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0x45, 0x4a, 0x41})
+	f.Add([]byte{0x10, 0x3f, 0x20, 0x50, 0x7f, 0x60})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		tree := rbts.New[int, int]()
+		want := map[int]bool{}
+		for i, op := range ops {
+			// The low six bits pick the key and bit 6 chooses delete over insert.
+			key := int(op & 0x3f)
+			if op&0x40 != 0 {
+				rbts.Delete(tree, key)
+				delete(want, key)
+			} else {
+				rbts.Insert(tree, key, i)
+				want[key] = true
+			}
+			if err := rbts.CheckInvariants(tree); err != nil {
+				t.Fatalf("after op %d (%#x): %v", i, op, err)
+			}
+			if rbts.Len(tree) != len(want) {
+				t.Fatalf("after op %d (%#x): Len = %d, want %d", i, op, rbts.Len(tree), len(want))
+			}
+		}
+	})
+}
+
+func TestVerifySizes(t *testing.T) {
+	tree := rbts.New[int, string]()
+	assert.True(t, rbts.VerifySizes(tree))
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+	}
+	for i := 0; i < 100; i += 4 {
+		rbts.Delete(tree, i)
+		require.True(t, rbts.VerifySizes(tree))
+	}
+
+	n, _ := rbts.Kth(tree, 30)
+	rbts.SetSize(n, 1000)
+	assert.False(t, rbts.VerifySizes(tree))
+	assert.Error(t, rbts.CheckInvariants(tree))
+}
+
+func TestStats(t *testing.T) {
+	assert.Equal(t, rbts.TreeStats[int]{}, rbts.Stats(rbts.New[int, string]()))
+
+	tree := rbts.New[int, string]()
+	for _, v := range []int{4, 2, 6, 1, 3, 5, 7} {
+		rbts.Insert(tree, v, "")
+	}
+	assert.Equal(t, rbts.TreeStats[int]{
+		Size:         7,
+		MinKey:       1,
+		MaxKey:       7,
+		Height:       3,
+		BlackHeight:  2,
+		RedNodes:     4,
+		AvgDepth:     10.0 / 7,
+		AvgLeafDepth: 2,
+		MinLeafDepth: 2,
+		MaxLeafDepth: 2,
+	}, rbts.Stats(tree))
+
+	sequential := rbts.New[int, string]()
+	for i := range 1000 {
+		rbts.Insert(sequential, i, "")
+	}
+	s := rbts.Stats(sequential)
+	assert.Equal(t, 1000, s.Size)
+	assert.LessOrEqual(t, s.Height, 2*10, "height is bounded by 2*log2(n+1)")
+	assert.LessOrEqual(t, float64(s.MinLeafDepth), s.AvgLeafDepth)
+	assert.LessOrEqual(t, s.AvgLeafDepth, float64(s.MaxLeafDepth))
+	assert.Equal(t, s.MaxLeafDepth+1, s.Height)
+
+	r := rand.New(rand.NewSource(109))
+	random := rbts.New[int, string]()
+	for i := range 5000 {
+		rbts.Insert(random, r.Intn(2000), "")
+		if i%3 == 0 {
+			rbts.Delete(random, r.Intn(2000))
+		}
+	}
+	require.True(t, rbts.IsValid(random))
+	s = rbts.Stats(random)
+	assert.Equal(t, rbts.Len(random), s.Size)
+	lo, _ := rbts.Min(random)
+	hi, _ := rbts.Max(random)
+	assert.Equal(t, lo.Key(), s.MinKey)
+	assert.Equal(t, hi.Key(), s.MaxKey)
+	blacks := s.Size - s.RedNodes
+	assert.GreaterOrEqual(t, blacks, s.BlackHeight, "every path holds BlackHeight black nodes")
+	assert.LessOrEqual(t, s.RedNodes, 2*blacks, "a black node has at most two red children")
+	assert.LessOrEqual(t, s.Height, 2*s.BlackHeight, "no red node has a red child")
+	assert.LessOrEqual(t, s.AvgDepth, float64(s.MaxLeafDepth))
+}
+
+func TestDeleteSizeStress(t *testing.T) {
+	r := rand.New(rand.NewSource(83))
+	tree := rbts.New[int, int]()
+	var want []int
+	for op := range 5000 {
+		key := r.Intn(1000)
+		i, found := slices.BinarySearch(want, key)
+		if r.Intn(2) == 0 {
+			rbts.Insert(tree, key, key)
+			if !found {
+				want = slices.Insert(want, i, key)
+			}
+		} else {
+			rbts.Delete(tree, key)
+			if found {
+				want = slices.Delete(want, i, i+1)
+			}
+		}
+
+		require.True(t, rbts.VerifySizes(tree), "op %d", op)
+		require.Equal(t, len(want), rbts.Len(tree), "op %d", op)
+		if len(want) == 0 {
+			continue
+		}
+		k := r.Intn(len(want))
+		n, ok := rbts.Kth(tree, k)
+		require.True(t, ok)
+		require.Equal(t, want[k], n.Key(), "op %d: Kth(%d)", op, k)
+		require.Equal(t, k, rbts.Rank(tree, want[k]), "op %d: Rank(%d)", op, want[k])
+	}
+}
+
+func TestDeleteDeepSuccessorSizes(t *testing.T) {
+	// Rebuild gives a perfect tree of 0..14 rooted at 7, whose successor 8 sits
+	// two levels down under 9 and 11. Deleting 7 moves 8 up to the root, and
+	// both 9 and 11 must lose one from their sizes.
+	for _, tree := range []*rbts.Tree[int, int]{rbts.New[int, int](), rbts.NewSummed[int, int]()} {
+		for i := range 15 {
+			rbts.Insert(tree, i, i)
+		}
+		rbts.Rebuild(tree)
+		require.Equal(t, 7, tree.Root.Key())
+
+		require.True(t, rbts.Delete(tree, 7))
+		require.Equal(t, 8, tree.Root.Key())
+		require.True(t, rbts.VerifySizes(tree))
+		assert.True(t, rbts.IsValid(tree))
+		for i, k := range []int{0, 1, 2, 3, 4, 5, 6, 8, 9, 10, 11, 12, 13, 14} {
+			n, ok := rbts.Kth(tree, i)
+			require.True(t, ok)
+			assert.Equal(t, k, n.Key())
+		}
+		assert.Equal(t, 9+10+11+12+13+14, rbts.RangeSum(tree, 9, 15))
+	}
+}
+
+func TestOnChange(t *testing.T) {
+	tree := rbts.NewSummed[string, int]()
+	var events []rbts.ChangeEvent[string, int]
+	tree.OnChange = func(e rbts.ChangeEvent[string, int]) {
+		require.True(t, rbts.IsValid(tree), "the change is complete when the hook runs")
+		events = append(events, e)
+	}
+
+	rbts.Insert(tree, "a", 1)
+	rbts.Insert(tree, "a", 2)
+	rbts.Update(tree, "a", 3)
+	rbts.Update(tree, "missing", 9)
+	rbts.Upsert(tree, "b", func(old int, _ bool) int { return old + 10 })
+	rbts.Upsert(tree, "b", func(old int, _ bool) int { return old + 10 })
+	rbts.Delete(tree, "a")
+	rbts.Delete(tree, "a")
+
+	assert.Equal(t, []rbts.ChangeEvent[string, int]{
+		{Kind: rbts.Inserted, Key: "a", New: 1},
+		{Kind: rbts.Updated, Key: "a", Old: 1, New: 2},
+		{Kind: rbts.Updated, Key: "a", Old: 2, New: 3},
+		{Kind: rbts.Inserted, Key: "b", New: 10},
+		{Kind: rbts.Updated, Key: "b", Old: 10, New: 20},
+		{Kind: rbts.Deleted, Key: "a", Old: 3},
+	}, events)
+
+	for i := range 20 {
+		rbts.Insert(tree, fmt.Sprint(i), i)
+	}
+	events = nil
+	keys := make([]string, 15)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+	}
+	assert.Equal(t, 15, rbts.DeleteAll(tree, keys))
+	assert.Len(t, events, 15, "bulk deletes are reported per key")
+	for _, e := range events {
+		assert.Equal(t, rbts.Deleted, e.Kind)
+	}
+
+	tree.OnChange = nil
+	rbts.Insert(tree, "quiet", 0)
+	assert.Len(t, events, 15)
+}
+
+func ExampleNew() {
+	tree := rbts.New[int, string]()
+	fmt.Println(rbts.Len(tree))
+	// Output: 0
+}
+
+func ExampleLen() {
+	tree := rbts.New[int, string]()
+	fmt.Println(rbts.Len(tree))
+	// Output: 0
+}
+
+func ExampleInsert() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	rbts.Insert(tree, 5, "five")
+	rbts.Insert(tree, 15, "fifteen")
+	fmt.Println(rbts.Len(tree))
+	// Output: 3
+}
+
+func ExampleDelete() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	rbts.Delete(tree, 10)
+	fmt.Println(rbts.Len(tree))
+	// Output: 0
+}
+
+func ExampleDeleteIf() {
+	sessions := rbts.New[string, int]()
+	rbts.Insert(sessions, "alice", 1700)
+	rbts.Insert(sessions, "bob", 1200)
+	now := 1500
+	isExpired := func(expiry int) bool { return expiry < now }
+	fmt.Println(rbts.DeleteIf(sessions, "alice", isExpired))
+	fmt.Println(rbts.DeleteIf(sessions, "bob", isExpired))
+	// Output:
+	// false
+	// true
+}
+
+func ExampleSearch() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "twenty")
+	node, found := rbts.Search(tree, 20)
+	fmt.Println(found, node.Value())
+	// Output: true twenty
+}
+
+func ExampleMin() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 10, "")
+	min, ok := rbts.Min(tree)
+	if ok {
+		fmt.Println(min.Key())
+	}
+	// Output: 10
+}
+
+func ExampleMax() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	max, ok := rbts.Max(tree)
+	if ok {
+		fmt.Println(max.Key())
+	}
+	// Output: 30
+}
+
+func ExampleFirst() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "b")
+	rbts.Insert(tree, 10, "a")
+	first, _ := rbts.First(tree)
+	fmt.Println(first.Key(), first.Value())
+	// Output: 10 a
+}
+
+func ExampleLast() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "b")
+	rbts.Insert(tree, 10, "a")
+	last, _ := rbts.Last(tree)
+	fmt.Println(last.Key(), last.Value())
+	// Output: 20 b
+}
+
+func ExampleCeiling() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, "")
+	}
+
+	n, _ := rbts.Ceiling(tree, 15)
+	fmt.Println(n.Key())
+	n, _ = rbts.Ceiling(tree, 20)
+	fmt.Println(n.Key())
+	// Output:
+	// 20
+	// 20
+}
+
+func ExampleFloor() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, "")
+	}
+
+	n, _ := rbts.Floor(tree, 25)
+	fmt.Println(n.Key())
+	n, _ = rbts.Floor(tree, 20)
+	fmt.Println(n.Key())
+	// Output:
+	// 20
+	// 20
+}
+
+func ExampleBracket() {
+	tree := rbts.New[float64, float64]()
+	rbts.Insert(tree, 0, 0)
+	rbts.Insert(tree, 10, 100)
+
+	// Linearly interpolate a value between the two nearest keys.
+	x := 2.5
+	lo, hi, _, _ := rbts.Bracket(tree, x)
+	frac := (x - lo.Key()) / (hi.Key() - lo.Key())
+	fmt.Println(lo.Value() + frac*(hi.Value()-lo.Value()))
+	// Output: 25
+}
+
+func ExampleNearestN() {
+	stations := rbts.New[float64, string]()
+	rbts.Insert(stations, 1.5, "north")
+	rbts.Insert(stations, 4.0, "central")
+	rbts.Insert(stations, 7.2, "south")
+	for _, n := range rbts.NearestN(stations, 5.0, 2) {
+		fmt.Println(n.Value())
+	}
+	// Output:
+	// central
+	// south
+}
+
+func ExampleHigher() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, "")
+	}
+
+	n, _ := rbts.Higher(tree, 15)
+	fmt.Println(n.Key())
+	n, _ = rbts.Higher(tree, 20)
+	fmt.Println(n.Key())
+	// Output:
+	// 20
+	// 30
+}
+
+func ExampleLower() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30} {
+		rbts.Insert(tree, v, "")
+	}
+
+	n, _ := rbts.Lower(tree, 15)
+	fmt.Println(n.Key())
+	n, _ = rbts.Lower(tree, 20)
+	fmt.Println(n.Key())
+	// Output:
+	// 10
+	// 10
+}
+
+func ExamplePredecessor() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 10, "")
+	node, _ := rbts.Search(tree, 20)
+	pred, ok := rbts.Predecessor(node)
+	if ok {
+		fmt.Println(pred.Key())
+	}
+	// Output: 10
+}
+
+func ExampleSuccessor() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	node, _ := rbts.Search(tree, 20)
+	succ, ok := rbts.Successor(node)
+	if ok {
+		fmt.Println(succ.Key())
+	}
+	// Output: 30
+}
+
+func ExampleInOrder() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 30, "")
+	for n := range rbts.InOrder(tree) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 10 20 30
+}
+
+func ExampleRange() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	for n := range rbts.Range(tree, 15, 25) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 20
+}
+
+func ExampleRank() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	rank := rbts.Rank(tree, 15)
+	fmt.Println(rank)
+	// Output: 1
+}
+
+func ExampleKth() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	n, _ := rbts.Kth(tree, 1)
+	fmt.Println(n.Key())
+	// Output: 20
+}
+
+func ExampleFilter() {
+	tree := rbts.New[int, string]()
+	for i := 1; i <= 6; i++ {
+		rbts.Insert(tree, i, "")
+	}
+	even := rbts.Filter(tree, func(k int, _ string) bool { return k%2 == 0 })
+	for n := range rbts.InOrder(even) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 2 4 6
+}
+
+func ExampleDepth() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	d, _ := rbts.Depth(tree, 30)
+	fmt.Println(d)
+	// Output: 1
+}
+
+func ExamplePath() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	path, _ := rbts.Path(tree, 30)
+	for _, n := range path {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 20 30
+}
+
+func ExampleRangeSum() {
+	tree := rbts.NewSummed[string, int]()
+	rbts.Insert(tree, "apples", 3)
+	rbts.Insert(tree, "bananas", 5)
+	rbts.Insert(tree, "cherries", 7)
+	fmt.Println(rbts.RangeSum(tree, "b", "z"))
+	// Output: 12
+}
+
+func ExampleSampleWeighted() {
+	servers := rbts.NewSummed[string, float64]()
+	rbts.Insert(servers, "large", 3)
+	rbts.Insert(servers, "small", 1)
+	total := rbts.RangeSum(servers, "", "~")
+	rng := rand.New(rand.NewSource(1))
+	picked := map[string]int{}
+	for range 1000 {
+		k, _ := rbts.SampleWeighted(servers, rng.Float64()*total)
+		picked[k]++
+	}
+	fmt.Println(picked["large"] > 2*picked["small"])
+	// Output: true
+}
+
+func ExampleInsertNode() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "a")
+	rbts.Insert(tree, 30, "c")
+	n, inserted := rbts.InsertNode(tree, 20, "b")
+	prev, _ := rbts.Predecessor(n)
+	fmt.Println(inserted, rbts.RankOfNode(n), prev.Value())
+	// Output: true 1 a
+}
+
+func ExampleInsertMulti() {
+	tree := rbts.New[string, int]()
+	rbts.InsertMulti(tree, "a", 1)
+	rbts.InsertMulti(tree, "a", 2)
+	rbts.InsertMulti(tree, "b", 3)
+	fmt.Println(rbts.Count(tree, "a"), rbts.Len(tree))
+	// Output: 2 3
+}
+
+func ExampleSelect() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 1, "one")
+	if _, err := rbts.Select(tree, 3); err != nil {
+		fmt.Println(err)
+	}
+	// Output: redblacktrees: rank 3 out of range for tree of size 1
+}
+
+func ExampleSelectEntry() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	rbts.Insert(tree, 20, "twenty")
+	k, v, _ := rbts.SelectEntry(tree, 1)
+	fmt.Println(k, v)
+	// Output: 20 twenty
+}
+
+func ExampleQuantile() {
+	tree := rbts.New[int, string]()
+	for i := 1; i <= 100; i++ {
+		rbts.Insert(tree, i, "")
+	}
+	p50, _, _ := rbts.Quantile(tree, 0.5)
+	p99, _, _ := rbts.Quantile(tree, 0.99)
+	fmt.Println(p50, p99)
+	// Output: 50 99
+}
+
+func ExampleQueryRange() {
+	tree := rbts.NewAggregated(0, func(_ string, v int) int { return v }, func(a, b int) int { return max(a, b) })
+	rbts.Insert(tree, "mon", 12)
+	rbts.Insert(tree, "tue", 31)
+	rbts.Insert(tree, "wed", 18)
+	fmt.Println(rbts.QueryRange[string, int, int](tree, "a", "tz"))
+	// Output: 31
+}
+
+func ExampleOverlapping() {
+	type booking struct {
+		end  int
+		room string
+	}
+	bookings := rbts.NewIntervals(func(b booking) int { return b.end })
+	rbts.Insert(bookings, 9, booking{11, "oak"})
+	rbts.Insert(bookings, 10, booking{12, "elm"})
+	rbts.Insert(bookings, 13, booking{15, "ash"})
+	for n := range rbts.Overlapping(bookings, 11, 14) {
+		fmt.Println(n.Key(), n.Value().room)
+	}
+	// Output:
+	// 10 elm
+	// 13 ash
+}
+
+func ExampleRangeMean() {
+	latency := rbts.NewMoments[int, int]()
+	for minute, ms := range []int{120, 80, 100, 300, 90} {
+		rbts.Insert(latency, minute, ms)
+	}
+	mean, _ := rbts.RangeMean(latency, 0, 3)
+	fmt.Println(mean)
+	// Output: 100
+}
+
+func ExampleRangeVariance() {
+	tree := rbts.NewMoments[int, int]()
+	for i, v := range []int{2, 4, 4, 4, 5, 5, 7, 9} {
+		rbts.Insert(tree, i, v)
+	}
+	variance, _ := rbts.RangeVariance(tree, 0, 8)
+	fmt.Println(variance)
+	// Output: 4
+}
+
+func ExampleKthInRange() {
+	prices := rbts.New[int, string]()
+	for _, p := range []int{5, 12, 18, 25, 31, 40} {
+		rbts.Insert(prices, p, "")
+	}
+	// The second-cheapest item priced in [10, 35).
+	n, _ := rbts.KthInRange(prices, 10, 35, 1)
+	fmt.Println(n.Key())
+	// Output: 18
+}
+
+func ExampleRankRange() {
+	tree := rbts.New[int, string]()
+	for i := 1; i <= 50; i++ {
+		rbts.Insert(tree, i*10, "")
+	}
+	start, count := rbts.RankRange(tree, 200, 300)
+	fmt.Printf("showing items %d-%d of %d\n", start+1, start+count, rbts.Len(tree))
+	// Output: showing items 20-29 of 50
+}
+
+func ExampleRankOfNode() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	n, _ := rbts.Search(tree, 30)
+	fmt.Println(rbts.RankOfNode(n))
+	// Output: 2
+}
+
+func ExampleBetween() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{1, 2, 3, 4, 5} {
+		rbts.Insert(tree, v, "")
+	}
+	for n := range rbts.Between(tree, 2, 4, false, true) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 3 4
+}
+
+func ExampleBetween_inclusivity() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{1, 2, 3, 4, 5} {
+		rbts.Insert(tree, v, "")
+	}
+	for _, c := range []struct {
+		name           string
+		incFrom, incTo bool
+	}{
+		{"[2, 4]", true, true},
+		{"[2, 4)", true, false},
+		{"(2, 4]", false, true},
+		{"(2, 4)", false, false},
+	} {
+		fmt.Print(c.name, ":")
+		for n := range rbts.Between(tree, 2, 4, c.incFrom, c.incTo) {
+			fmt.Print(" ", n.Key())
+		}
+		fmt.Println()
+	}
+	// Output:
+	// [2, 4]: 2 3 4
+	// [2, 4): 2 3
+	// (2, 4]: 3 4
+	// (2, 4): 3
+}
+
+func ExampleRangeReverse() {
+	log := rbts.New[int, string]()
+	for ts, msg := range []string{"boot", "login", "query", "logout", "shutdown"} {
+		rbts.Insert(log, ts, msg)
+	}
+	for n := range rbts.RangeReverse(log, 1, 4) {
+		fmt.Println(n.Key(), n.Value())
+	}
+	// Output:
+	// 3 logout
+	// 2 query
+	// 1 login
+}
+
+func ExampleRangePage() {
+	tree := rbts.New[int, string]()
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+	}
+	for n := range rbts.RangePage(tree, 10, 90, 20, 5) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 30 31 32 33 34
+}
+
+func ExampleCountLess() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	fmt.Println(rbts.CountLess(tree, 20))
+	// Output: 1
+}
+
+func ExampleCountGreater() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	rbts.Insert(tree, 20, "")
+	rbts.Insert(tree, 30, "")
+	fmt.Println(rbts.CountGreater(tree, 10))
+	// Output: 2
+}
+
+func ExampleRangeSlice() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40} {
+		rbts.Insert(tree, v, fmt.Sprint("v", v))
+	}
+	for _, n := range rbts.RangeSlice(tree, 15, 40) {
+		fmt.Println(n.Key(), n.Value())
+	}
+	// Output:
+	// 20 v20
+	// 30 v30
+}
+
+func ExampleSplitRanges() {
+	tree := rbts.New[int, int]()
+	for i := 1; i <= 9; i++ {
+		rbts.Insert(tree, i, i)
+	}
+	var wg sync.WaitGroup
+	sums := make([]int, 3)
+	for i, c := range rbts.SplitRanges(tree, 3) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range rbts.Between(tree, c[0], c[1], true, true) {
+				sums[i] += n.Value()
+			}
+		}()
+	}
+	wg.Wait()
+	fmt.Println(sums)
+	// Output: [6 15 24]
+}
+
+func ExampleRangePrefix() {
+	commands := rbts.New[string, string]()
+	for _, c := range []string{"commit", "checkout", "cherry-pick", "clone", "diff"} {
+		rbts.Insert(commands, c, "")
+	}
+	for n := range rbts.RangePrefix(commands, "ch") {
+		fmt.Println(n.Key())
+	}
+	// Output:
+	// checkout
+	// cherry-pick
+}
+
+func ExampleFirstN() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{50, 10, 40, 20, 30} {
+		rbts.Insert(tree, v, "")
+	}
+	for n := range rbts.FirstN(tree, 2) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 10 20
+}
+
+func ExampleLastN() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{50, 10, 40, 20, 30} {
+		rbts.Insert(tree, v, "")
+	}
+	for n := range rbts.LastN(tree, 2) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 40 50
+}
+
+func ExamplePartition() {
+	tree := rbts.New[string, bool]()
+	rbts.Insert(tree, "a", true)
+	rbts.Insert(tree, "b", false)
+	rbts.Insert(tree, "c", true)
+	active, expired := rbts.Partition(tree, func(_ string, live bool) bool { return live })
+	fmt.Println(rbts.Len(active), rbts.Len(expired))
+	// Output: 2 1
+}
+
+func ExampleGroupBy() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 1, "login")
+	rbts.Insert(tree, 2, "click")
+	rbts.Insert(tree, 3, "login")
+	rbts.Insert(tree, 4, "logout")
+	groups := rbts.GroupBy(tree, func(_ int, event string) string { return event })
+	for n := range rbts.InOrder(groups["login"]) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println(len(groups))
+	// Output: 1 3 3
+}
+
+func ExampleIsSubset() {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	rbts.Insert(a, 2, "")
+	rbts.Insert(b, 1, "")
+	rbts.Insert(b, 2, "")
+	fmt.Println(rbts.IsSubset(a, b), rbts.IsSubset(b, a))
+	// Output: true false
+}
+
+func ExampleIsSuperset() {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	rbts.Insert(a, 1, "")
+	rbts.Insert(a, 2, "")
+	rbts.Insert(b, 2, "")
+	fmt.Println(rbts.IsSuperset(a, b))
+	// Output: true
+}
+
+func ExampleNewMulti() {
+	tree := rbts.NewMulti[string, int]()
+	rbts.Insert(tree, "a", 1)
+	rbts.Insert(tree, "a", 2)
+	rbts.Delete(tree, "a")
+	for n := range rbts.InOrder(tree) {
+		fmt.Println(n.Key(), n.Value())
+	}
+	// Output: a 2
+}
+
+func ExampleCount() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "")
+	fmt.Println(rbts.Count(tree, 10), rbts.Count(tree, 20))
+	// Output: 1 0
+}
+
+func ExampleAnyInRange() {
+	busy := rbts.New[int, string]()
+	rbts.Insert(busy, 9, "standup")
+	rbts.Insert(busy, 14, "review")
+	fmt.Println(rbts.AnyInRange(busy, 10, 14))
+	fmt.Println(rbts.AnyInRange(busy, 13, 15))
+	// Output:
+	// false
+	// true
+}
+
+func ExampleCountRange() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40} {
+		rbts.Insert(tree, v, "")
+	}
+	fmt.Println(rbts.CountRange(tree, 15, 40))
+	// Output: 2
+}
+
+func ExampleSymmetricDifference() {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	for _, v := range []int{1, 2, 3} {
+		rbts.Insert(a, v, "")
+	}
+	for _, v := range []int{2, 3, 4} {
+		rbts.Insert(b, v, "")
+	}
+	for n := range rbts.InOrder(rbts.SymmetricDifference(a, b)) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 1 4
+}
+
+func ExampleReset() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	rbts.Reset(tree)
+	rbts.Insert(tree, 20, "twenty")
+	fmt.Println(rbts.Len(tree))
+	// Output: 1
+}
+
+func ExampleMerge() {
+	dst := rbts.New[string, int]()
+	src := rbts.New[string, int]()
+	rbts.Insert(dst, "a", 1)
+	rbts.Insert(dst, "b", 2)
+	rbts.Insert(src, "b", 20)
+	rbts.Insert(src, "c", 30)
+	rbts.Merge(dst, src)
+	for n := range rbts.InOrder(dst) {
+		fmt.Print(n.Key(), "=", n.Value(), " ")
+	}
+	fmt.Println()
+	// Output: a=1 b=20 c=30
+}
+
+func ExampleRetainRange() {
+	tree := rbts.New[int, string]()
+	for i := 1; i <= 6; i++ {
+		rbts.Insert(tree, i, "")
+	}
+	removed := rbts.RetainRange(tree, 2, 5)
+	for n := range rbts.InOrder(tree) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println("removed", removed)
+	// Output: 2 3 4 removed 3
+}
+
+func ExampleDeleteMin() {
+	queue := rbts.New[int, string]()
+	rbts.Insert(queue, 3, "low")
+	rbts.Insert(queue, 1, "urgent")
+	rbts.Insert(queue, 2, "normal")
+	_, task, _ := rbts.DeleteMin(queue)
+	fmt.Println(task, rbts.Len(queue))
+	// Output: urgent 2
+}
+
+func ExampleDeleteMax() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 1, "a")
+	rbts.Insert(tree, 2, "b")
+	k, v, _ := rbts.DeleteMax(tree)
+	fmt.Println(k, v)
+	// Output: 2 b
+}
+
+func ExampleNewCapped() {
+	fastest := rbts.NewCapped[float64, string](2, rbts.EvictMax)
+	fastest.Insert(9.8, "ana")
+	fastest.Insert(10.4, "ben")
+	fastest.Insert(9.6, "cy")
+	for n := range rbts.InOrder(fastest.Tree()) {
+		fmt.Println(n.Key(), n.Value())
+	}
+	// Output:
+	// 9.6 cy
+	// 9.8 ana
+}
+
+func ExampleNewTimeTree() {
+	schedule := rbts.NewTimeTree[string]()
+	day := time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)
+	schedule.Insert(day.Add(14*time.Hour), "review")
+	schedule.Insert(day.Add(9*time.Hour), "standup")
+	schedule.Insert(day.Add(11*time.Hour), "design")
+	for at, task := range schedule.All() {
+		fmt.Println(at.Format("15:04"), task)
+	}
+	// Output:
+	// 09:00 standup
+	// 11:00 design
+	// 14:00 review
+}
+
+func ExampleFromPairs() {
+	readings := []rbts.Pair[string, int]{
+		{Key: "eu", Value: 40}, {Key: "us", Value: 75}, {Key: "eu", Value: 55},
+	}
+	keepMax := func(existing, incoming int) int { return max(existing, incoming) }
+	tree, conflicts := rbts.FromPairs(readings, keepMax)
+	for n := range rbts.InOrder(tree) {
+		fmt.Println(n.Key(), n.Value())
+	}
+	fmt.Println("conflicts:", conflicts)
+	// Output:
+	// eu 55
+	// us 75
+	// conflicts: 1
+}
+
+func ExampleClone() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	snapshot := rbts.Clone(tree)
+	rbts.Insert(tree, 20, "twenty")
+	fmt.Println(rbts.Len(tree), rbts.Len(snapshot))
+	// Output: 2 1
+}
+
+func ExampleCloneSubtree() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{4, 2, 6, 1, 3, 5, 7} {
+		rbts.Insert(tree, v, "")
+	}
+	n, _ := rbts.Search(tree, 2)
+	sub := rbts.CloneSubtree(n)
+	for n := range rbts.InOrder(sub) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 1 2 3
+}
+
+func ExampleRebuild() {
+	tree := rbts.New[int, string]()
+	for i := range 100 {
+		rbts.Insert(tree, i, "")
+	}
+	rbts.DeleteAll(tree, []int{1, 2, 3})
+	rbts.Rebuild(tree)
+	fmt.Println(rbts.Len(tree), rbts.Stats(tree).Height)
+	// Output: 97 7
+}
+
+func ExampleSubtreeInOrder() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{4, 2, 6, 1, 3, 5, 7} {
+		rbts.Insert(tree, v, "")
+	}
+	n, _ := rbts.Search(tree, 6)
+	for m := range rbts.SubtreeInOrder(n) {
+		fmt.Print(m.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 5 6 7
+}
+
+func ExampleInOrderNodes() {
+	tree := rbts.New[string, int]()
+	rbts.Insert(tree, "a", 1)
+	rbts.Insert(tree, "b", 2)
+	for n := range rbts.InOrderNodes(tree) {
+		n.SetValue(n.Value() * 10)
+	}
+	for n := range rbts.InOrder(tree) {
+		fmt.Print(n.Key(), "=", n.Value(), " ")
+	}
+	fmt.Println()
+	// Output: a=10 b=20
+}
+
+func ExampleInOrderNoAlloc() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 2, "b")
+	rbts.Insert(tree, 1, "a")
+	for n := range rbts.InOrderNoAlloc(tree) {
+		fmt.Print(n.Value())
+	}
+	fmt.Println()
+	// Output: ab
+}
+
+func ExampleInOrderInto() {
+	tree := rbts.New[int, string]()
+	var buf []rbts.Node[int, string]
+	for round := range 2 {
+		rbts.Insert(tree, round, fmt.Sprint("r", round))
+		buf = rbts.InOrderInto(tree, buf[:0])
+		fmt.Println(len(buf), buf[len(buf)-1].Value())
+	}
+	// Output:
+	// 1 r0
+	// 2 r1
+}
+
+func ExampleCollect() {
+	tree := rbts.New[string, int]()
+	rbts.Insert(tree, "b", 2)
+	rbts.Insert(tree, "a", 1)
+	fmt.Println(rbts.Collect(tree, func(k string, v int) string { return fmt.Sprintf("%s=%d", k, v) }))
+	// Output:
+	// [a=1 b=2]
+}
+
+func ExampleEnumerateInOrder() {
+	scores := rbts.New[int, string]()
+	rbts.Insert(scores, 70, "cy")
+	rbts.Insert(scores, 95, "ana")
+	rbts.Insert(scores, 82, "ben")
+	for i, n := range rbts.EnumerateInOrder(scores) {
+		fmt.Println(i, n.Value())
+	}
+	// Output:
+	// 0 cy
+	// 1 ben
+	// 2 ana
+}
+
+func ExampleTakeWhile() {
+	// Keys 1, 2, 3 are consecutive; 5 starts after a gap.
+	tree := rbts.New[int, string]()
+	for _, v := range []int{1, 2, 3, 5, 6} {
+		rbts.Insert(tree, v, "")
+	}
+	next := 1
+	for n := range rbts.TakeWhile(tree, func(k int, _ string) bool { return k == next }) {
+		fmt.Print(n.Key(), " ")
+		next++
+	}
+	fmt.Println()
+	// Output: 1 2 3
+}
+
+func ExampleDropWhile() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{1, 2, 3, 5, 6} {
+		rbts.Insert(tree, v, "")
+	}
+	for n := range rbts.DropWhile(tree, func(k int, _ string) bool { return k < 4 }) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 5 6
+}
+
+func ExampleNode_SetValue() {
+	tree := rbts.New[string, int]()
+	rbts.Insert(tree, "hits", 1)
+	if n, found := rbts.Search(tree, "hits"); found {
+		n.SetValue(n.Value() + 1)
+	}
+	n, _ := rbts.Search(tree, "hits")
+	fmt.Println(n.Value())
+	// Output: 2
+}
+
+func ExampleIsValid() {
+	tree := rbts.New[int, string]()
+	for i := range 10 {
+		rbts.Insert(tree, i, "")
+	}
+	rbts.Delete(tree, 3)
+	fmt.Println(rbts.IsValid(tree))
+	// Output: true
+}
+
+func ExampleDeleteNode() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	rbts.Insert(tree, 20, "twenty")
+	if n, found := rbts.Search(tree, 10); found {
+		rbts.DeleteNode(tree, n)
+	}
+	fmt.Println(rbts.Len(tree))
+	// Output: 1
+}
+
+func ExampleMergeIter() {
+	primary := rbts.New[string, int]()
+	rbts.Insert(primary, "b", 1)
+	rbts.Insert(primary, "d", 1)
+	fallback := rbts.New[string, int]()
+	rbts.Insert(fallback, "a", 2)
+	rbts.Insert(fallback, "b", 2)
+	rbts.Insert(fallback, "c", 2)
+	for k, v := range rbts.MergeIter(primary, fallback) {
+		fmt.Print(k, v, " ")
+	}
+	fmt.Println()
+	// Output: a2 b1 c2 d1
+}
+
+func ExampleMergeIterFunc() {
+	stock := rbts.New[string, int]()
+	rbts.Insert(stock, "apple", 3)
+	rbts.Insert(stock, "pear", 1)
+	incoming := rbts.New[string, int]()
+	rbts.Insert(incoming, "apple", 2)
+	rbts.Insert(incoming, "fig", 5)
+	total := func(a, b int) int { return a + b }
+	for k, v := range rbts.MergeIterFunc(stock, incoming, total) {
+		fmt.Print(k, "=", v, " ")
+	}
+	fmt.Println()
+	// Output: apple=5 fig=5 pear=1
+}
+
+func ExampleEqual() {
+	a := rbts.New[int, string]()
+	b := rbts.New[int, string]()
+	rbts.Insert(a, 1, "x")
+	rbts.Insert(a, 2, "y")
+	rbts.Insert(b, 2, "y")
+	rbts.Insert(b, 1, "x")
+	fmt.Println(rbts.Equal(a, b))
+	// Output: true
+}
+
+func ExampleEqualFunc() {
+	a := rbts.New[string, float64]()
+	b := rbts.New[string, float64]()
+	tenth, fifth := 0.1, 0.2
+	rbts.Insert(a, "latency", tenth+fifth)
+	rbts.Insert(b, "latency", 0.3)
+	withinTolerance := func(x, y float64) bool { return math.Abs(x-y) < 1e-9 }
+	fmt.Println(rbts.Equal(a, b), rbts.EqualFunc(a, b, withinTolerance))
+	// Output: false true
+}
+
+func ExampleEqualKeys() {
+	index := rbts.New[string, []byte]()
+	replica := rbts.New[string, []byte]()
+	rbts.Insert(index, "doc1", []byte("v1"))
+	rbts.Insert(replica, "doc1", []byte("v2"))
+	fmt.Println(rbts.EqualKeys(index, replica))
+	// Output: true
+}
+
+func ExampleCompare() {
+	newTree := func(keys ...int) *rbts.Tree[int, int] {
+		tree := rbts.New[int, int]()
+		for _, k := range keys {
+			rbts.Insert(tree, k, 0)
+		}
+		return tree
+	}
+	trees := []*rbts.Tree[int, int]{newTree(1, 3), newTree(1, 2, 9), newTree(1)}
+	slices.SortFunc(trees, rbts.Compare[int, int])
+	for _, tree := range trees {
+		fmt.Println(rbts.Len(tree))
+	}
+	// Output:
+	// 1
+	// 3
+	// 2
+}
+
+func ExampleDiff() {
+	prev := rbts.New[string, int]()
+	next := rbts.New[string, int]()
+	rbts.Insert(prev, "a", 1)
+	rbts.Insert(prev, "b", 2)
+	rbts.Insert(next, "b", 3)
+	rbts.Insert(next, "c", 4)
+	added, removed, changed := rbts.Diff(prev, next)
+	fmt.Println(added, removed, changed)
+	// Output: [c] [a] [b]
+}
+
+func ExamplePatch() {
+	tree := rbts.New[string, int]()
+	rbts.Insert(tree, "a", 1)
+	rbts.Insert(tree, "b", 2)
+	rbts.Patch(tree, map[string]int{"c": 3}, []string{"a"}, map[string]int{"b": 20})
+	for n := range rbts.InOrder(tree) {
+		fmt.Print(n.Key(), "=", n.Value(), " ")
+	}
+	fmt.Println()
+	// Output: b=20 c=3
+}
+
+func ExampleTree_MarshalBinary() {
+	tree := rbts.New[string, int]()
+	rbts.Insert(tree, "b", 2)
+	rbts.Insert(tree, "a", 1)
+	data, err := tree.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+
+	restored := rbts.New[string, int]()
+	if err := restored.UnmarshalBinary(data); err != nil {
+		panic(err)
+	}
+	for n := range rbts.InOrder(restored) {
+		fmt.Print(n.Key(), "=", n.Value(), " ")
+	}
+	fmt.Println()
+	// Output: a=1 b=2
+}
+
+func ExampleUpdate() {
+	tree := rbts.New[string, int]()
+	rbts.Insert(tree, "a", 1)
+	fmt.Println(rbts.Update(tree, "a", 2), rbts.Update(tree, "b", 3), rbts.Len(tree))
+	// Output: true false 1
+}
+
+func ExampleCompareAndSwap() {
+	versions := rbts.New[string, int]()
+	rbts.Insert(versions, "doc", 3)
+	fmt.Println(rbts.CompareAndSwap(versions, "doc", 3, 4))
+	fmt.Println(rbts.CompareAndSwap(versions, "doc", 3, 4))
+	// Output:
+	// true
+	// false
+}
+
+func ExampleDeleteAll() {
+	tree := rbts.New[int, string]()
+	for i := range 5 {
+		rbts.Insert(tree, i, "")
+	}
+	fmt.Println(rbts.DeleteAll(tree, []int{1, 3, 3, 7}), rbts.Len(tree))
+	// Output: 2 3
+}
+
+func ExampleUpsert() {
+	tree := rbts.New[string, int]()
+	runningMax := func(v int) func(int, bool) int {
+		return func(old int, existed bool) int {
+			if existed {
+				return max(old, v)
+			}
+			return v
+		}
+	}
+	rbts.Upsert(tree, "cpu", runningMax(40))
+	rbts.Upsert(tree, "cpu", runningMax(75))
+	rbts.Upsert(tree, "cpu", runningMax(60))
+	n, _ := rbts.Search(tree, "cpu")
+	fmt.Println(n.Value())
+	// Output: 75
+}
+
+func ExampleSuccessorOf() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	rbts.Insert(tree, 20, "twenty")
+	k, v, _ := rbts.SuccessorOf(tree, 10)
+	fmt.Println(k, v)
+	// Output: 20 twenty
+}
+
+func ExamplePredecessorOf() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 10, "ten")
+	rbts.Insert(tree, 20, "twenty")
+	k, v, _ := rbts.PredecessorOf(tree, 15)
+	fmt.Println(k, v)
+	// Output: 10 ten
+}
+
+func ExampleValueOr() {
+	config := rbts.New[string, string]()
+	rbts.Insert(config, "level", "debug")
+	fmt.Println(rbts.ValueOr(config, "level", "info"))
+	fmt.Println(rbts.ValueOr(config, "format", "text"))
+	// Output:
+	// debug
+	// text
+}
+
+func ExampleGetRef() {
+	tree := rbts.New[string, []string]()
+	rbts.Insert(tree, "fruits", []string{"apple"})
+	if ref, ok := rbts.GetRef(tree, "fruits"); ok {
+		*ref = append(*ref, "banana")
+	}
+	n, _ := rbts.Search(tree, "fruits")
+	fmt.Println(n.Value())
+	// Output: [apple banana]
+}
+
+func ExampleValueOf() {
+	tree := rbts.New[int, string]()
+	n, _ := rbts.Search(tree, 1)
+	v, ok := rbts.ValueOf(n)
+	fmt.Printf("%q %v\n", v, ok)
+	// Output: "" false
+}
+
+func ExampleFromRank() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40} {
+		rbts.Insert(tree, v, "")
+	}
+	for n := range rbts.FromRank(tree, 2) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 30 40
+}
+
+func ExampleFromDescending() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{10, 20, 30, 40} {
+		rbts.Insert(tree, v, "")
+	}
+	for n := range rbts.FromDescending(tree, 25) {
+		fmt.Print(n.Key(), " ")
+	}
+	fmt.Println()
+	// Output: 20 10
+}
+
+type keyPrinter struct{}
+
+func (keyPrinter) Visit(n *rbts.Node[int, string]) bool {
+	fmt.Print(n.Key(), " ")
+	return true
+}
+
+func ExampleWalk() {
+	tree := rbts.New[int, string]()
+	for _, v := range []int{2, 1, 3} {
+		rbts.Insert(tree, v, "")
+	}
+	rbts.Walk(tree, rbts.PostOrder, keyPrinter{})
+	fmt.Println()
+	// Output: 1 3 2
+}
+
+func ExampleWalkEuler() {
+	// Print the tree as nested parentheses: (left key right).
+	tree := rbts.New[int, string]()
+	for _, v := range []int{2, 1, 3} {
+		rbts.Insert(tree, v, "")
+	}
+	rbts.WalkEuler(tree, rbts.EulerVisitor[int, string]{
+		Pre:  func(*rbts.Node[int, string]) bool { fmt.Print("("); return true },
+		In:   func(n *rbts.Node[int, string]) bool { fmt.Print(n.Key()); return true },
+		Post: func(*rbts.Node[int, string]) bool { fmt.Print(")"); return true },
+	})
+	fmt.Println()
+	// Output: ((1)2(3))
+}
+
+func ExampleCheckInvariants() {
+	tree := rbts.New[int, string]()
+	rbts.Insert(tree, 1, "one")
+	rbts.Insert(tree, 2, "two")
+	fmt.Println(rbts.CheckInvariants(tree))
+	// Output: <nil>
+}
+
+func ExampleVerifySizes() {
+	tree := rbts.New[int, string]()
+	for i := range 10 {
+		rbts.Insert(tree, i, "")
+	}
+	rbts.Delete(tree, 5)
+	fmt.Println(rbts.VerifySizes(tree))
+	// Output: true
+}
+
+func ExampleStats() {
+	tree := rbts.New[int, string]()
+	for i := range 7 {
+		rbts.Insert(tree, i, "")
+	}
+	s := rbts.Stats(tree)
+	fmt.Println(s.Size, s.Height, s.BlackHeight, s.MinKey, s.MaxKey)
+	// Output: 7 4 2 0 6
+}
+
+func ExampleEntry() {
+	counts := rbts.New[string, int]()
+	for _, word := range strings.Fields("to be or not to be") {
+		rbts.Entry(counts, word).AndModify(func(n *int) { *n++ }).OrInsert(1)
+	}
+	for n := range rbts.InOrder(counts) {
+		fmt.Print(n.Key(), "=", n.Value(), " ")
+	}
+	fmt.Println()
+	// Output: be=2 not=1 or=1 to=2
+}
+
+func ExampleChangeEvent() {
+	tree := rbts.New[string, int]()
+	tree.OnChange = func(e rbts.ChangeEvent[string, int]) {
+		switch e.Kind {
+		case rbts.Inserted:
+			fmt.Println("insert", e.Key, e.New)
+		case rbts.Updated:
+			fmt.Println("update", e.Key, e.Old, "->", e.New)
+		case rbts.Deleted:
+			fmt.Println("delete", e.Key, e.Old)
+		}
+	}
+	rbts.Insert(tree, "x", 1)
+	rbts.Insert(tree, "x", 2)
+	rbts.Delete(tree, "x")
+	// Output:
+	// insert x 1
+	// update x 1 -> 2
+	// delete x 2
+}
+
+func BenchmarkInsertRandom(b *testing.B) {
+	r := rand.New(rand.NewSource(42))
+	tree := rbts.New[int, string]()
+	keys := make([]int, b.N)
+	for i := range keys {
+		keys[i] = r.Intn(1_000_000)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rbts.Insert(tree, keys[i], "value")
+	}
+}
+
+func BenchmarkInsertSequential(b *testing.B) {
+	tree := rbts.New[int, string]()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rbts.Insert(tree, i, "value")
+	}
+}
+
+func BenchmarkSearchHit(b *testing.B) {
+	tree := rbts.New[int, string]()
+	for i := 0; i < 1000; i++ {
+		rbts.Insert(tree, i, "value")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rbts.Search(tree, i%1000)
+	}
+}
+
+func BenchmarkSearchMiss(b *testing.B) {
 	tree := rbts.New[int, string]()
 	for i := range 1000 {
 		rbts.Insert(tree, i, "value")
@@ -492,3 +4753,123 @@ func BenchmarkDeleteRandom(b *testing.B) {
 		rbts.Delete(tree, keys[perm[i%1000]])
 	}
 }
+
+func BenchmarkClearRefill(b *testing.B) {
+	tree := rbts.New[int, string]()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rbts.Clear(tree)
+		for k := range 64 {
+			rbts.Insert(tree, k, "value")
+		}
+	}
+}
+
+func BenchmarkResetRefill(b *testing.B) {
+	tree := rbts.New[int, string]()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rbts.Reset(tree)
+		for k := range 64 {
+			rbts.Insert(tree, k, "value")
+		}
+	}
+}
+
+type largeValue [32]int64
+
+var sink int64
+
+func BenchmarkInOrder(b *testing.B) {
+	tree := rbts.New[int, largeValue]()
+	for i := range 1000 {
+		rbts.Insert(tree, i, largeValue{})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n := range rbts.InOrder(tree) {
+			sink += n.Value()[0]
+		}
+	}
+}
+
+func BenchmarkInOrderNodes(b *testing.B) {
+	tree := rbts.New[int, largeValue]()
+	for i := range 1000 {
+		rbts.Insert(tree, i, largeValue{})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for n := range rbts.InOrderNodes(tree) {
+			sink += n.Value()[0]
+		}
+	}
+}
+
+func BenchmarkDeleteAll(b *testing.B) {
+	r := rand.New(rand.NewSource(42))
+	keys := r.Perm(10_000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		tree := rbts.New[int, string]()
+		for k := range 10_000 {
+			rbts.Insert(tree, k, "value")
+		}
+		b.StartTimer()
+		rbts.DeleteAll(tree, keys[:5_000])
+	}
+}
+
+func smallTrees() []*rbts.Tree[int, int] {
+	trees := make([]*rbts.Tree[int, int], 100)
+	for i := range trees {
+		trees[i] = rbts.New[int, int]()
+		for k := range 16 {
+			rbts.Insert(trees[i], k, k)
+		}
+	}
+	return trees
+}
+
+func BenchmarkInOrderSmallTrees(b *testing.B) {
+	trees := smallTrees()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tree := range trees {
+			for n := range rbts.InOrder(tree) {
+				sink += int64(n.Value())
+			}
+		}
+	}
+}
+
+func BenchmarkInOrderNoAllocSmallTrees(b *testing.B) {
+	trees := smallTrees()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, tree := range trees {
+			for n := range rbts.InOrderNoAlloc(tree) {
+				sink += int64(n.Value())
+			}
+		}
+	}
+}
+
+func BenchmarkInOrderInto(b *testing.B) {
+	tree := rbts.New[int, largeValue]()
+	for i := range 1000 {
+		rbts.Insert(tree, i, largeValue{})
+	}
+	var buf []rbts.Node[int, largeValue]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = rbts.InOrderInto(tree, buf[:0])
+		sink += buf[len(buf)-1].Value()[0]
+	}
+}